@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Certificate attributes
+//==============================================================================================================================
+const ATTRIBUTE_ROLE = "role"
+const ATTRIBUTE_USERNAME = "username"
+const ATTRIBUTE_LENDER_ID = "lenderId"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type CallerDetails struct {
+	Username string
+	Role     string
+	LenderId int
+}
+
+//==============================================================================================================================
+//	 Permission matrix - Roles allowed to call each invoke and query function
+//==============================================================================================================================
+var ALL_ROLES = []string{BORROWER, DEALER, LENDER, ADMIN}
+
+var permissions = map[string][]string{
+	// Invoke functions
+	"CreateLoanApplication":      {BORROWER, DEALER},
+	"CreateSealedBidApplication": {BORROWER, DEALER},
+	"ConfirmBid":                 {BORROWER},
+	"ChangePaymentStatus":        {LENDER},
+	"WithdrawLoanApplication":    {BORROWER},
+	"ExpireStaleApplications":    {ADMIN},
+	"SetLenderProduct":           {LENDER},
+	"EraseBorrowerData":          {ADMIN},
+	"UpdateKYCStatus":            {LENDER, ADMIN},
+	"AddApplicationParty":        {BORROWER, DEALER},
+	"AcceptApplicationParty":     {BORROWER},
+	"RegisterVehicle":            {DEALER, ADMIN},
+	"SetVehicleValuation":        {ADMIN},
+	"SetDepreciationCurve":       {ADMIN},
+	"RegisterDealer":             {ADMIN},
+	"UpdateDealerStatus":         {ADMIN, COMPLIANCE},
+	"SetDealerAgreement":         {LENDER},
+	"SettleDealerCommission":     {LENDER},
+	"RecordDisbursement":         {LENDER},
+	"InviteSyndicateParticipant": {LENDER},
+	"AcceptSyndicateInvitation":  {LENDER},
+	"OfferLoanTransfer":          {LENDER},
+	"AcceptLoanTransfer":         {LENDER},
+	"CancelLoanTransfer":         {LENDER},
+	"CreatePool":                 {LENDER},
+	"AddLoanToPool":              {LENDER},
+	"AddPoolTranche":             {LENDER},
+	"IssuePool":                  {LENDER},
+	"RunPoolDistribution":        {LENDER},
+	"AccrueInterest":             {LENDER},
+	"SetFraudRuleSettings":       {ADMIN},
+	"ReviewFlaggedApplication":   {ADMIN, COMPLIANCE},
+	"AddScreeningEntry":          {COMPLIANCE},
+	"RemoveScreeningEntry":       {COMPLIANCE},
+	"SetUnderwritingPolicy":      {LENDER},
+	"ProposeUnderwritingTerms":   {LENDER},
+	"CheckUnderwritingTerms":     {LENDER},
+	"AddDocument":                {BORROWER, DEALER, LENDER},
+	"VerifyDocument":             {LENDER},
+	"SetRequiredDocuments":       {LENDER},
+	"SetExposureLimits":          {LENDER},
+	"SetProvisionRate":           {LENDER},
+	"RunProvisioning":            {LENDER},
+	"AddGLAccount":               {LENDER},
+	"ChargeLoanFee":              {LENDER},
+	"WriteOffLoan":               {LENDER},
+	"RecordLoanRecovery":         {LENDER},
+	"RequestRevisedTerms":        {BORROWER},
+	"CounterOffer":               {LENDER},
+	"DeclineRevisedTerms":        {LENDER},
+	"CommitSealedBid":            {LENDER},
+	"RevealSealedBid":            {LENDER},
+	"RankSealedBids":             {BORROWER, DEALER, ADMIN},
+
+	// Query functions
+	"GetApplicationDetails":   ALL_ROLES,
+	"GetMyApplications":       {BORROWER, DEALER, LENDER},
+	"GetNoDuesCertificate":    ALL_ROLES,
+	"VerifyNoDuesCertificate": ALL_ROLES,
+	"GetLenderProduct":        ALL_ROLES,
+	"GetSealedBidAuction":     ALL_ROLES,
+	"FindApplicationsBySSN":   {LENDER, ADMIN},
+	"GetBorrower":             ALL_ROLES,
+	"GetBorrowerLoans":        ALL_ROLES,
+	"GetBorrowerExposure":     {BORROWER, LENDER, ADMIN},
+	"GetVehicle":              ALL_ROLES,
+	"GetVehicleValuation":     ALL_ROLES,
+	"GetDealer":               ALL_ROLES,
+	"GetDealerInventory":      ALL_ROLES,
+	"GetDealerStatement":      {DEALER, LENDER, ADMIN},
+	"GetLenderPortfolio":      {LENDER, ADMIN},
+	"GetLoanOwnership":        {LENDER, ADMIN},
+	"GetPool":                 {LENDER, ADMIN},
+	"GetPoolInvestorReport":   {LENDER, ADMIN},
+	"GetChartOfAccounts":      {LENDER, ADMIN},
+	"GetTrialBalance":         {LENDER, ADMIN},
+	"GetAccountStatement":     {LENDER, ADMIN},
+	"GetProvisioningReport":   {LENDER, ADMIN},
+	"GetLenderExposure":       {LENDER, ADMIN},
+	"GetFraudRuleSettings":    {LENDER, ADMIN},
+	"GetScreeningList":        {COMPLIANCE, ADMIN},
+	"GetScreeningResults":     {COMPLIANCE, ADMIN},
+	"GetUnderwritingQueue":    {LENDER, ADMIN},
+	"GetApplicationDocuments": ALL_ROLES,
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetMyApplications(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Borrowers and dealers get their own applications, lenders the ones they are involved in or can bid on
+	var applications []LoanApplication
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil {
+			continue
+		}
+		if t.CheckApplicationViewAccess(caller, applicationDetails) != nil {
+			continue
+		}
+		applications = append(applications, t.FilterApplicationForCaller(stub, caller, applicationDetails))
+	}
+
+	return json.Marshal(applications)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetCallerDetails(stub shim.ChaincodeStubInterface) (CallerDetails, error) {
+
+	var caller CallerDetails
+
+	username, err := stub.ReadCertAttribute(ATTRIBUTE_USERNAME)
+	if err != nil {
+		return caller, errors.New("Couldn't get attribute 'username'. Error: " + err.Error())
+	}
+	role, err := stub.ReadCertAttribute(ATTRIBUTE_ROLE)
+	if err != nil {
+		return caller, errors.New("Couldn't get attribute 'role'. Error: " + err.Error())
+	}
+	caller.Username = string(username)
+	caller.Role = string(role)
+
+	// Lenders are identified by the lender id used on their bids
+	if caller.Role == LENDER {
+		lenderId, err := stub.ReadCertAttribute(ATTRIBUTE_LENDER_ID)
+		if err != nil {
+			return caller, errors.New("Couldn't get attribute 'lenderId'. Error: " + err.Error())
+		}
+		caller.LenderId, err = strconv.Atoi(string(lenderId))
+		if err != nil {
+			return caller, errors.New("Invalid attribute 'lenderId'")
+		}
+	}
+
+	return caller, nil
+}
+
+func (t *SmartLendingChaincode) CheckPermission(stub shim.ChaincodeStubInterface, function string) error {
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return err
+	}
+
+	allowedRoles, found := permissions[function]
+	if !found {
+		return errors.New("Function " + function + " is not permitted")
+	}
+	for i := 0; i < len(allowedRoles); i++ {
+		if allowedRoles[i] == caller.Role {
+			return nil
+		}
+	}
+	return errors.New("Function " + function + " is not permitted for role " + caller.Role)
+}
+
+func (t *SmartLendingChaincode) CheckApplicationAccess(caller CallerDetails, applicationDetails LoanApplication) error {
+
+	// Lenders reach only the applications they are involved in, further restrictions are applied by the individual functions
+	if caller.Role == ADMIN {
+		return nil
+	} else if caller.Role == LENDER && t.IsLenderOnApplication(applicationDetails, caller.LenderId) {
+		return nil
+	} else if caller.Role == BORROWER && applicationDetails.BorrowerUsername == caller.Username {
+		return nil
+	} else if caller.Role == DEALER && applicationDetails.DealerId != "" && applicationDetails.DealerId == caller.Username {
+		return nil
+	}
+	return errors.New("Access denied to application " + applicationDetails.ApplicationNumber)
+}
+
+func (t *SmartLendingChaincode) CheckApplicationViewAccess(caller CallerDetails, applicationDetails LoanApplication) error {
+
+	// Co-applicants and guarantors can see the application but cannot act on it
+	if caller.Role == BORROWER {
+		for i := 0; i < len(applicationDetails.Parties); i++ {
+			if applicationDetails.Parties[i].Username == caller.Username {
+				return nil
+			}
+		}
+	}
+	// An application open for sealed bidding is offered to every lender
+	if caller.Role == LENDER && applicationDetails.Status == STATE_SEALED_BIDDING {
+		return nil
+	}
+	return t.CheckApplicationAccess(caller, applicationDetails)
+}
+
+func (t *SmartLendingChaincode) IsLenderOnApplication(applicationDetails LoanApplication, lenderId int) bool {
+
+	// A lender is involved once it has quoted, holds or has been invited to a share or has been offered one
+	if t.HasLenderBid(applicationDetails, lenderId) {
+		return true
+	}
+	for i := 0; i < len(applicationDetails.Participants); i++ {
+		if applicationDetails.Participants[i].LenderId == lenderId {
+			return true
+		}
+	}
+	for i := 0; i < len(applicationDetails.TransferOffers); i++ {
+		if applicationDetails.TransferOffers[i].BuyerLenderId == lenderId {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) CheckLenderAccess(caller CallerDetails, lenderId int) error {
+	if caller.Role != LENDER || caller.LenderId != lenderId {
+		return errors.New("Access denied for lender " + strconv.Itoa(lenderId))
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) GetWinningBid(applicationDetails LoanApplication) (BiddingDetails, bool) {
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		if applicationDetails.Quotations[i].IsWinningBid {
+			return applicationDetails.Quotations[i], true
+		}
+	}
+	return BiddingDetails{}, false
+}
+
+func (t *SmartLendingChaincode) HasLenderBid(applicationDetails LoanApplication, lenderId int) bool {
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		if applicationDetails.Quotations[i].LenderId == lenderId {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) FilterApplicationForCaller(stub shim.ChaincodeStubInterface, caller CallerDetails, applicationDetails LoanApplication) LoanApplication {
+
+	if caller.Role != LENDER {
+		return applicationDetails
+	}
+
+	// Lenders do not get to see the quotes and negotiations of the other lenders
+	var quotes []BiddingDetails
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		if applicationDetails.Quotations[i].LenderId == caller.LenderId {
+			quotes = append(quotes, applicationDetails.Quotations[i])
+		}
+	}
+	var negotiations []NegotiationRound
+	for i := 0; i < len(applicationDetails.Negotiations); i++ {
+		if applicationDetails.Negotiations[i].LenderId == caller.LenderId {
+			negotiations = append(negotiations, applicationDetails.Negotiations[i])
+		}
+	}
+	applicationDetails.Quotations = quotes
+	applicationDetails.Negotiations = negotiations
+
+	return applicationDetails
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetInstallmentAmount(sanctionedAmount float64, interestRate float64, tenure int) float64 {
+
+	// Same simple interest installment as the generated repayment schedule, the tenure is in years
+	if tenure <= 0 {
+		return 0
+	}
+	principalAmount := sanctionedAmount / float64(tenure*12)
+	return t.RoundAmount(principalAmount + principalAmount*interestRate/100)
+}
+
+func (t *SmartLendingChaincode) GetMonthlyObligations(stub shim.ChaincodeStubInterface, borrowerId string, applicationNumber string) float64 {
+
+	borrower, err := t.GetBorrowerDetails(stub, borrowerId)
+	if err != nil {
+		return 0
+	}
+
+	// The next unpaid installment of every other booked loan, or the installment it will carry once disbursed
+	var obligations float64 = 0
+	for i := 0; i < len(borrower.Applications); i++ {
+		if borrower.Applications[i] == applicationNumber {
+			continue
+		}
+		applicationDetails, err := t.GetApplication(stub, borrower.Applications[i])
+		if err != nil || !t.IsActiveLoan(applicationDetails) || applicationDetails.Status == STATE_WRITTEN_OFF {
+			continue
+		}
+		if len(applicationDetails.RepaymentSchedule) == 0 {
+			winningBid, _ := t.GetWinningBid(applicationDetails)
+			obligations = obligations + t.GetInstallmentAmount(winningBid.SanctionedAmount, winningBid.InterestRate, winningBid.Tenure)
+			continue
+		}
+		for j := 0; j < len(applicationDetails.RepaymentSchedule); j++ {
+			if applicationDetails.RepaymentSchedule[j].RepaymentStatus != STATE_RECOVERED {
+				obligations = obligations + applicationDetails.RepaymentSchedule[j].TotalEMI
+				break
+			}
+		}
+	}
+	return t.RoundAmount(obligations)
+}
+
+func (t *SmartLendingChaincode) GetApplicantsObligations(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) float64 {
+
+	// Co-applicants' income counts towards the loan, so do their obligations
+	obligations := t.GetMonthlyObligations(stub, applicationDetails.BorrowerId, applicationDetails.ApplicationNumber)
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Role == PARTY_CO_APPLICANT && applicationDetails.Parties[i].Accepted {
+			obligations = obligations + t.GetMonthlyObligations(stub, applicationDetails.Parties[i].BorrowerId, applicationDetails.ApplicationNumber)
+		}
+	}
+	return t.RoundAmount(obligations)
+}
+
+func (t *SmartLendingChaincode) GetApplicantsIncome(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (float64, error) {
+
+	profile, err := t.GetBorrowerProfile(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return 0, err
+	}
+	monthlyIncome := profile.MonthlyIncome
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Role != PARTY_CO_APPLICANT || !applicationDetails.Parties[i].Accepted {
+			continue
+		}
+		coApplicant, err := t.GetBorrowerProfile(stub, applicationDetails.Parties[i].BorrowerId)
+		if err != nil {
+			return 0, err
+		}
+		monthlyIncome = monthlyIncome + coApplicant.MonthlyIncome
+	}
+	return monthlyIncome, nil
+}
+
+func (t *SmartLendingChaincode) GetDebtToIncome(installmentAmount float64, obligations float64, monthlyIncome float64) float64 {
+	if monthlyIncome <= 0 {
+		return 0
+	}
+	return t.RoundAmount((installmentAmount + obligations) * 100 / monthlyIncome)
+}
+
+func (t *SmartLendingChaincode) ApplyAffordabilityPolicy(stub shim.ChaincodeStubInterface, bidDetails BiddingDetails, evaluationParams EvaluationParams) BiddingDetails {
+
+	if bidDetails.ApplicationAcceptStatus != LENDER_ACCEPT_APPLICATION {
+		return bidDetails
+	}
+
+	bidDetails.InstallmentAmount = t.GetInstallmentAmount(bidDetails.SanctionedAmount, bidDetails.InterestRate, bidDetails.Tenure)
+	bidDetails.DebtToIncome = t.GetDebtToIncome(bidDetails.InstallmentAmount, evaluationParams.Obligations, evaluationParams.MonthlyIncome)
+
+	// A maximum DTI of zero means the lender does not test affordability
+	product := t.GetLenderProduct(stub, bidDetails.LenderId)
+	if product.MaxDTI <= 0 || bidDetails.DebtToIncome <= product.MaxDTI {
+		return bidDetails
+	}
+	if !product.AllowReducedSanction {
+		return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: "Installment exceeds the maximum debt to income ratio"}
+	}
+
+	// Resize the sanction to the largest installment the applicants can afford
+	maxInstallment := evaluationParams.MonthlyIncome*product.MaxDTI/100 - evaluationParams.Obligations
+	if maxInstallment <= 0 {
+		return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: "Existing obligations exceed the maximum debt to income ratio"}
+	}
+	bidDetails.SanctionedAmount = math.Floor(maxInstallment*float64(bidDetails.Tenure*12)*100/(1+bidDetails.InterestRate/100)) / 100
+	bidDetails.InstallmentAmount = t.GetInstallmentAmount(bidDetails.SanctionedAmount, bidDetails.InterestRate, bidDetails.Tenure)
+	bidDetails.DebtToIncome = t.GetDebtToIncome(bidDetails.InstallmentAmount, evaluationParams.Obligations, evaluationParams.MonthlyIncome)
+
+	return bidDetails
+}
+
+func (t *SmartLendingChaincode) CheckAffordability(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, bidDetails BiddingDetails) (BiddingDetails, error) {
+
+	monthlyIncome, err := t.GetApplicantsIncome(stub, applicationDetails)
+	if err != nil {
+		return bidDetails, err
+	}
+	obligations := t.GetApplicantsObligations(stub, applicationDetails)
+	bidDetails.InstallmentAmount = t.GetInstallmentAmount(bidDetails.SanctionedAmount, bidDetails.InterestRate, bidDetails.Tenure)
+	bidDetails.DebtToIncome = t.GetDebtToIncome(bidDetails.InstallmentAmount, obligations, monthlyIncome)
+
+	product := t.GetLenderProduct(stub, bidDetails.LenderId)
+	if product.MaxDTI > 0 && bidDetails.DebtToIncome > product.MaxDTI {
+		return bidDetails, errors.New("Installment exceeds the maximum debt to income ratio")
+	}
+	return bidDetails, nil
+}
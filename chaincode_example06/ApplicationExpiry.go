@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) WithdrawLoanApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	// An application can be withdrawn only until a bid has been confirmed
+	if applicationDetails.Status != STATE_APPLIED && applicationDetails.Status != STATE_QUOTATIONS_RECEIVED && applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Application can no longer be withdrawn")
+	}
+
+	applicationDetails.Status = STATE_WITHDRAWN
+	applicationDetails = t.CloseOpenNegotiations(applicationDetails)
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+func (t *SmartLendingChaincode) ExpireStaleApplications(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the applications which no longer have a live bid to the expired state
+	var expiredApplications []string
+	currentTime := t.GetTransactionTime(stub)
+	for i := 0; i < len(applicationIndex); i++ {
+		bytes, err := stub.GetState(applicationIndex[i])
+		if err != nil || bytes == nil {
+			continue
+		}
+		var applicationDetails LoanApplication
+		err = json.Unmarshal(bytes, &applicationDetails)
+		if err != nil {
+			continue
+		}
+
+		if applicationDetails.Status == STATE_QUOTATIONS_RECEIVED && !t.HasLiveBid(applicationDetails, currentTime) {
+			applicationDetails.Status = STATE_EXPIRED
+			applicationDetails = t.CloseOpenNegotiations(applicationDetails)
+			applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+			expiredApplications = append(expiredApplications, applicationDetails.ApplicationNumber)
+		}
+	}
+
+	return json.Marshal(expiredApplications)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) IsBidExpired(bidDetails BiddingDetails, currentTime time.Time) bool {
+	return !bidDetails.BidValidUntil.IsZero() && currentTime.After(bidDetails.BidValidUntil)
+}
+
+func (t *SmartLendingChaincode) HasLiveBid(applicationDetails LoanApplication, currentTime time.Time) bool {
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		if applicationDetails.Quotations[i].ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION && !applicationDetails.Quotations[i].IsSuperseded && !t.IsBidExpired(applicationDetails.Quotations[i], currentTime) {
+			return true
+		}
+		// A bid still with the underwriters keeps the application open
+		if applicationDetails.Quotations[i].ApplicationAcceptStatus == LENDER_REFER_APPLICATION && !applicationDetails.Quotations[i].IsSuperseded {
+			return true
+		}
+	}
+	return false
+}
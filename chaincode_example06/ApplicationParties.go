@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Party roles on a loan application
+//==============================================================================================================================
+const PARTY_PRIMARY = "PRIMARY"
+const PARTY_CO_APPLICANT = "CO_APPLICANT"
+const PARTY_GUARANTOR = "GUARANTOR"
+
+//==============================================================================================================================
+//	 Event names
+//==============================================================================================================================
+const GUARANTOR_ADDED_EVENT = "GuarantorAdded"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type ApplicationParty struct {
+	BorrowerId      string
+	Username        string
+	Role            string
+	AddedDate       time.Time
+	Accepted        bool
+	AcceptedDate    time.Time
+	IsLiable        bool
+	LiabilityAmount float64
+	LiabilityDate   time.Time
+}
+
+type GuaranteeNotification struct {
+	ApplicationNumber string
+	BorrowerId        string
+	Guarantors        []ApplicationParty
+	LiabilityAmount   float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number, party role, party username, SSN hash, age, monthly income,
+// credit score and for a new borrower the id of their data key and their details encrypted under it
+func (t *SmartLendingChaincode) AddApplicationParty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, role, username, SSN hash, age, monthly income and credit score")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parties can be added only until a bid has been accepted
+	if applicationDetails.Status != STATE_APPLIED && applicationDetails.Status != STATE_QUOTATIONS_RECEIVED && applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Parties can no longer be added to the application")
+	}
+
+	role := args[1]
+	if role != PARTY_CO_APPLICANT && role != PARTY_GUARANTOR {
+		return nil, errors.New("Invalid party role")
+	}
+	username := args[2]
+	if username == "" || username == applicationDetails.BorrowerUsername {
+		return nil, errors.New("Invalid party username")
+	}
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Username == username {
+			return nil, errors.New("Party has already been added to the application")
+		}
+	}
+	age, err := strconv.Atoi(args[4])
+	if err != nil {
+		return nil, errors.New("Invalid age")
+	}
+	monthlyIncome, err := strconv.ParseFloat(args[5], 64)
+	if err != nil {
+		return nil, errors.New("Invalid monthly income")
+	}
+	creditScore, err := strconv.Atoi(args[6])
+	if err != nil {
+		return nil, errors.New("Invalid credit score")
+	}
+	var dataKeyId string = ""
+	if len(args) > 7 {
+		dataKeyId = args[7]
+	}
+	var encryptedPII string = ""
+	if len(args) > 8 {
+		encryptedPII = args[8]
+	}
+
+	// Every party is a borrower in their own right
+	profile := BorrowerProfile{Age: age, MonthlyIncome: monthlyIncome, CreditScore: creditScore}
+	borrower, err := t.RegisterBorrower(stub, username, applicationDetails.ApplicationNumber, role, args[3], profile, dataKeyId, encryptedPII)
+	if err != nil {
+		return nil, err
+	}
+	if borrower.BorrowerId == applicationDetails.BorrowerId {
+		return nil, errors.New("Borrower cannot be a party to their own application")
+	}
+
+	var party ApplicationParty
+	party.BorrowerId = borrower.BorrowerId
+	party.Username = username
+	party.Role = role
+	party.AddedDate = t.GetTransactionTime(stub)
+	applicationDetails.Parties = append(applicationDetails.Parties, party)
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	// The guarantor is asked to accept the guarantee
+	if role == PARTY_GUARANTOR {
+		notification := GuaranteeNotification{ApplicationNumber: applicationDetails.ApplicationNumber, BorrowerId: applicationDetails.BorrowerId, Guarantors: []ApplicationParty{party}}
+		bytes, err := json.Marshal(notification)
+		if err == nil {
+			err = stub.SetEvent(GUARANTOR_ADDED_EVENT, bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(applicationDetails)
+}
+
+// A party named on an application is bound by it only once they accept their role themselves, until then a
+// co-applicant's income does not count and a guarantor cannot be made liable. Argument is the application number
+func (t *SmartLendingChaincode) AcceptApplicationParty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parties can accept only until a bid has been accepted
+	if applicationDetails.Status != STATE_APPLIED && applicationDetails.Status != STATE_QUOTATIONS_RECEIVED && applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Parties can no longer accept the application")
+	}
+
+	var found bool = false
+	var role string
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Username != caller.Username {
+			continue
+		}
+		if applicationDetails.Parties[i].Accepted {
+			return nil, errors.New("Party has already accepted the application")
+		}
+		applicationDetails.Parties[i].Accepted = true
+		applicationDetails.Parties[i].AcceptedDate = t.GetTransactionTime(stub)
+		role = applicationDetails.Parties[i].Role
+		found = true
+	}
+	if !found {
+		return nil, errors.New("Caller is not a party to application " + applicationDetails.ApplicationNumber)
+	}
+
+	// Lenders re-evaluate the application with the combined income
+	if applicationDetails.Status == STATE_QUOTATIONS_RECEIVED && role == PARTY_CO_APPLICANT {
+		applicationDetails, err = t.RefreshQuotations(stub, applicationDetails)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) BuildEvaluationParams(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (EvaluationParams, error) {
+
+	var evaluationParams EvaluationParams
+
+	borrower, err := t.GetBorrowerDetails(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return evaluationParams, err
+	}
+	if borrower.PIIStatus == PII_ERASED {
+		return evaluationParams, errors.New("Borrower data has been erased")
+	}
+
+	evaluationParams.ApplicationNumber = applicationDetails.ApplicationNumber
+	evaluationParams.LoanAmount = applicationDetails.LoanAmount
+	evaluationParams.SSNHash = borrower.SSNHash
+	evaluationParams.Age = borrower.Profile.Age
+	evaluationParams.MonthlyIncome = borrower.Profile.MonthlyIncome
+	evaluationParams.CreditScore = borrower.Profile.CreditScore
+	evaluationParams.Tenure = applicationDetails.Tenure
+	evaluationParams.AssetValue = t.GetAssetValue(stub, applicationDetails)
+
+	// Co-applicants share the repayment, so their income is added to the borrower's once they have accepted
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Role != PARTY_CO_APPLICANT || !applicationDetails.Parties[i].Accepted {
+			continue
+		}
+		coApplicant, err := t.GetBorrowerProfile(stub, applicationDetails.Parties[i].BorrowerId)
+		if err != nil {
+			return evaluationParams, err
+		}
+		evaluationParams.MonthlyIncome = evaluationParams.MonthlyIncome + coApplicant.MonthlyIncome
+	}
+	evaluationParams.Obligations = t.GetApplicantsObligations(stub, applicationDetails)
+
+	return evaluationParams, nil
+}
+
+func (t *SmartLendingChaincode) RefreshQuotations(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (LoanApplication, error) {
+
+	evaluationParams, err := t.BuildEvaluationParams(stub, applicationDetails)
+	if err != nil {
+		return applicationDetails, err
+	}
+	quotes := t.GetQuotesFromLenders(stub, applicationDetails, evaluationParams)
+
+	// The fresh quotes supersede the open and referred bids of the same lender
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		if applicationDetails.Quotations[i].IsSuperseded || applicationDetails.Quotations[i].ApplicationAcceptStatus == LENDER_REJECT_APPLICATION {
+			continue
+		}
+		applicationDetails.Quotations[i].IsSuperseded = true
+		for j := 0; j < len(quotes); j++ {
+			if quotes[j].LenderId == applicationDetails.Quotations[i].LenderId {
+				applicationDetails.Quotations[i].SupersededBy = quotes[j].BiddingNumber
+			}
+		}
+	}
+	applicationDetails.Quotations = append(applicationDetails.Quotations, quotes...)
+	applicationDetails = t.CloseOpenNegotiations(applicationDetails)
+
+	return applicationDetails, nil
+}
+
+// The guarantors are notified through the loan status event raised by the caller
+func (t *SmartLendingChaincode) InvokeGuarantees(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (LoanApplication, GuaranteeNotification, error) {
+
+	// The guarantors become liable for all the dues outstanding on the loan
+	var outstandingDues float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus != STATE_RECOVERED {
+			outstandingDues = outstandingDues + applicationDetails.RepaymentSchedule[i].TotalEMI
+		}
+	}
+
+	var notification GuaranteeNotification
+	var guarantors []ApplicationParty
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].Role != PARTY_GUARANTOR || !applicationDetails.Parties[i].Accepted {
+			continue
+		}
+		applicationDetails.Parties[i].IsLiable = true
+		applicationDetails.Parties[i].LiabilityAmount = outstandingDues
+		applicationDetails.Parties[i].LiabilityDate = t.GetTransactionTime(stub)
+		guarantors = append(guarantors, applicationDetails.Parties[i])
+	}
+	if len(guarantors) == 0 {
+		return applicationDetails, notification, nil
+	}
+
+	notification = GuaranteeNotification{ApplicationNumber: applicationDetails.ApplicationNumber, BorrowerId: applicationDetails.BorrowerId, Guarantors: guarantors, LiabilityAmount: outstandingDues}
+	return applicationDetails, notification, nil
+}
+
+func (t *SmartLendingChaincode) IsPendingParty(applicationDetails LoanApplication, borrowerId string) bool {
+
+	for i := 0; i < len(applicationDetails.Parties); i++ {
+		if applicationDetails.Parties[i].BorrowerId == borrowerId {
+			return !applicationDetails.Parties[i].Accepted
+		}
+	}
+	return false
+}
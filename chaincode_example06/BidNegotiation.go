@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Status types - Negotiation round
+//==============================================================================================================================
+const NEGOTIATION_REQUESTED = 0
+const NEGOTIATION_COUNTERED = 1
+const NEGOTIATION_DECLINED = 2
+const NEGOTIATION_CLOSED = 3
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type NegotiationRound struct {
+	RoundNumber           int
+	BiddingNumber         int
+	LenderId              int
+	RequestedInterestRate float64
+	RequestedTenure       int
+	RequestDate           time.Time
+	Status                int
+	CounterBiddingNumber  int
+	DeclineReason         string
+	ResponseDate          time.Time
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) RequestRevisedTerms(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, bidding number, interest rate and tenure")
+	}
+
+	applicationDetails, err := t.GetNegotiableApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+	biddingNumber, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid bidding number")
+	}
+
+	bidIndex := t.FindLiveBid(applicationDetails, biddingNumber, t.GetTransactionTime(stub))
+	if bidIndex < 0 {
+		return nil, errors.New("Bid not found or no longer open for negotiation")
+	}
+	bidDetails := applicationDetails.Quotations[bidIndex]
+
+	// Blank values keep the terms of the bid unchanged
+	requestedRate := bidDetails.InterestRate
+	if args[2] != "" {
+		requestedRate, err = strconv.ParseFloat(args[2], 64)
+		if err != nil || requestedRate <= 0 {
+			return nil, errors.New("Invalid interest rate")
+		}
+	}
+	requestedTenure := bidDetails.Tenure
+	if args[3] != "" {
+		requestedTenure, err = strconv.Atoi(args[3])
+		if err != nil || requestedTenure <= 0 {
+			return nil, errors.New("Invalid tenure")
+		}
+	}
+
+	if requestedRate > bidDetails.InterestRate {
+		return nil, errors.New("Requested interest rate must not be higher than the bid")
+	}
+	if requestedRate == bidDetails.InterestRate && requestedTenure == bidDetails.Tenure {
+		return nil, errors.New("Requested terms are the same as the bid")
+	}
+
+	// Only one round can be open on a bid at a time
+	for i := 0; i < len(applicationDetails.Negotiations); i++ {
+		if applicationDetails.Negotiations[i].BiddingNumber == biddingNumber && applicationDetails.Negotiations[i].Status == NEGOTIATION_REQUESTED {
+			return nil, errors.New("Revised terms already requested on this bid")
+		}
+	}
+
+	var round NegotiationRound
+	round.RoundNumber = len(applicationDetails.Negotiations) + 1
+	round.BiddingNumber = biddingNumber
+	round.LenderId = bidDetails.LenderId
+	round.RequestedInterestRate = requestedRate
+	round.RequestedTenure = requestedTenure
+	round.RequestDate = t.GetTransactionTime(stub)
+	round.Status = NEGOTIATION_REQUESTED
+	applicationDetails.Negotiations = append(applicationDetails.Negotiations, round)
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+func (t *SmartLendingChaincode) CounterOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, round number, interest rate and tenure")
+	}
+
+	applicationDetails, err := t.GetNegotiableApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	roundIndex, err := t.FindOpenNegotiationRound(applicationDetails, args[1])
+	if err != nil {
+		return nil, err
+	}
+	interestRate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || interestRate <= 0 {
+		return nil, errors.New("Invalid interest rate")
+	}
+	tenure, err := strconv.Atoi(args[3])
+	if err != nil || tenure <= 0 {
+		return nil, errors.New("Invalid tenure")
+	}
+
+	round := applicationDetails.Negotiations[roundIndex]
+	err = t.CheckNegotiationLender(stub, round)
+	if err != nil {
+		return nil, err
+	}
+
+	bidIndex := t.FindLiveBid(applicationDetails, round.BiddingNumber, t.GetTransactionTime(stub))
+	if bidIndex < 0 {
+		return nil, errors.New("Bid is no longer open for negotiation")
+	}
+
+	// The counter-offer is a fresh bid which supersedes the one under negotiation
+	counterBid := applicationDetails.Quotations[bidIndex]
+	counterBid.BiddingNumber, err = t.GetNextBiddingNumber(stub)
+	if err != nil {
+		return nil, err
+	}
+	counterBid.BiddingDate = t.GetTransactionTime(stub)
+	counterBid.InterestRate = interestRate
+	counterBid.Tenure = tenure
+	counterBid.BidValidUntil = t.GetBidValidUntil(stub, counterBid.LenderId)
+	counterBid.IsWinningBid = false
+
+	// The revised terms must still be affordable for the applicants and within the lender's LTV and exposure limits
+	counterBid, err = t.CheckAffordability(stub, applicationDetails, counterBid)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLTV(stub, applicationDetails, counterBid.LenderId, counterBid.SanctionedAmount)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckExposureLimits(stub, applicationDetails, counterBid.LenderId, counterBid.SanctionedAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	// The underwriter's sign-off covered the original terms only, so revised terms are referred back to underwriting
+	if counterBid.UnderwrittenBy != "" {
+		referralReason := "Counter-offer at " + strconv.FormatFloat(interestRate, 'f', -1, 64) + "% over " + strconv.Itoa(tenure) + " years on underwritten terms"
+		counterBid = BiddingDetails{ApplicationNumber: counterBid.ApplicationNumber, BiddingNumber: counterBid.BiddingNumber, BiddingDate: counterBid.BiddingDate, LenderId: counterBid.LenderId, ApplicationAcceptStatus: LENDER_REFER_APPLICATION, ReferralReason: referralReason}
+	}
+
+	applicationDetails.Quotations[bidIndex].IsSuperseded = true
+	applicationDetails.Quotations[bidIndex].SupersededBy = counterBid.BiddingNumber
+	applicationDetails.Quotations = append(applicationDetails.Quotations, counterBid)
+
+	applicationDetails.Negotiations[roundIndex].Status = NEGOTIATION_COUNTERED
+	applicationDetails.Negotiations[roundIndex].CounterBiddingNumber = counterBid.BiddingNumber
+	applicationDetails.Negotiations[roundIndex].ResponseDate = t.GetTransactionTime(stub)
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+func (t *SmartLendingChaincode) DeclineRevisedTerms(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, round number and reason")
+	}
+
+	applicationDetails, err := t.GetNegotiableApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	roundIndex, err := t.FindOpenNegotiationRound(applicationDetails, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.CheckNegotiationLender(stub, applicationDetails.Negotiations[roundIndex])
+	if err != nil {
+		return nil, err
+	}
+
+	// The original bid stays open for the borrower to accept
+	applicationDetails.Negotiations[roundIndex].Status = NEGOTIATION_DECLINED
+	applicationDetails.Negotiations[roundIndex].DeclineReason = args[2]
+	applicationDetails.Negotiations[roundIndex].ResponseDate = t.GetTransactionTime(stub)
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetNegotiableApplication(stub shim.ChaincodeStubInterface, applicationNumber string) (LoanApplication, error) {
+
+	applicationDetails, err := t.GetApplication(stub, applicationNumber)
+	if err != nil {
+		return applicationDetails, err
+	}
+
+	if applicationDetails.Status != STATE_QUOTATIONS_RECEIVED {
+		return applicationDetails, errors.New("Application is not open for negotiation")
+	}
+	return applicationDetails, nil
+}
+
+func (t *SmartLendingChaincode) FindLiveBid(applicationDetails LoanApplication, biddingNumber int, currentTime time.Time) int {
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		bidDetails := applicationDetails.Quotations[i]
+		if bidDetails.BiddingNumber == biddingNumber && bidDetails.ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION && !bidDetails.IsSuperseded && !t.IsBidExpired(bidDetails, currentTime) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *SmartLendingChaincode) FindOpenNegotiationRound(applicationDetails LoanApplication, roundNumberArg string) (int, error) {
+
+	roundNumber, err := strconv.Atoi(roundNumberArg)
+	if err != nil {
+		return -1, errors.New("Invalid round number")
+	}
+
+	for i := 0; i < len(applicationDetails.Negotiations); i++ {
+		if applicationDetails.Negotiations[i].RoundNumber == roundNumber {
+			if applicationDetails.Negotiations[i].Status != NEGOTIATION_REQUESTED {
+				return -1, errors.New("Negotiation round has already been responded to")
+			}
+			return i, nil
+		}
+	}
+	return -1, errors.New("Negotiation round not found")
+}
+
+func (t *SmartLendingChaincode) CheckNegotiationLender(stub shim.ChaincodeStubInterface, round NegotiationRound) error {
+
+	// Only the lender whose bid is under negotiation can respond
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return err
+	}
+	return t.CheckLenderAccess(caller, round.LenderId)
+}
+
+func (t *SmartLendingChaincode) CloseOpenNegotiations(applicationDetails LoanApplication) LoanApplication {
+	for i := 0; i < len(applicationDetails.Negotiations); i++ {
+		if applicationDetails.Negotiations[i].Status == NEGOTIATION_REQUESTED {
+			applicationDetails.Negotiations[i].Status = NEGOTIATION_CLOSED
+		}
+	}
+	return applicationDetails
+}
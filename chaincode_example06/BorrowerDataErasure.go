@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Borrower data erasure - Keys and event names
+//==============================================================================================================================
+const ERASURE_PREFIX = "ERASURE_"
+const BORROWER_DATA_ERASED_EVENT = "BorrowerDataErased"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+// The key service listens for the erasure event and destroys the data key named in the record
+type ErasureRecord struct {
+	BorrowerId    string
+	DataKeyId     string
+	Applications  []string
+	RequestedBy   string
+	TransactionId string
+	ErasureDate   time.Time
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) EraseBorrowerData(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting borrower id")
+	}
+
+	borrower, err := t.GetBorrowerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if borrower.PIIStatus == PII_ERASED {
+		return nil, errors.New("Borrower data has already been erased")
+	}
+
+	var erasure ErasureRecord
+	erasure.BorrowerId = borrower.BorrowerId
+	erasure.DataKeyId = borrower.DataKeyId
+	erasure.Applications = borrower.Applications
+	caller, err := t.GetCallerDetails(stub)
+	if err == nil {
+		erasure.RequestedBy = caller.Username
+	}
+	erasure.TransactionId = stub.GetTxID()
+	erasure.ErasureDate = t.GetTransactionTime(stub)
+
+	// The details encrypted under the data key become unreadable once the key service destroys it, the profile
+	// kept for the lenders' decisions and the SSN hash which could link the borrower back are removed. The loan
+	// financials are left untouched
+	err = stub.DelState(SSN_INDEX_PREFIX + borrower.SSNHash)
+	if err != nil {
+		return nil, err
+	}
+	borrower.SSNHash = ""
+	borrower.DataKeyId = ""
+	borrower.EncryptedPII = ""
+	borrower.PIIStatus = PII_ERASED
+	borrower.Profile = BorrowerProfile{}
+	borrower.StatedIncomes = nil
+	borrower.UpdatedDate = erasure.ErasureDate
+	err = t.SaveBorrower(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(erasure)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(ERASURE_PREFIX+borrower.BorrowerId, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.SetEvent(BORROWER_DATA_ERASED_EVENT, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Borrowers - Keys
+//==============================================================================================================================
+const BORROWER_PREFIX = "BORROWER_"
+const BORROWER_SEQUENCE = "_borrowersequence"
+
+//==============================================================================================================================
+//	Status types - KYC status of a borrower
+//==============================================================================================================================
+const KYC_PENDING = "PENDING"
+const KYC_VERIFIED = "VERIFIED"
+const KYC_REJECTED = "REJECTED"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type Borrower struct {
+	BorrowerId             string
+	Username               string
+	SSNHash                string
+	DataKeyId              string
+	EncryptedPII           string
+	PIIStatus              string
+	Profile                BorrowerProfile
+	KYCStatus              string
+	KYCUpdatedBy           string
+	KYCUpdatedDate         time.Time
+	KYCHistory             []KYCStatusChange
+	Applications           []string
+	GuaranteedApplications []string
+	StatedIncomes          []StatedIncome
+	Documents              []string
+	CreatedDate            time.Time
+	UpdatedDate            time.Time
+}
+
+type KYCStatusChange struct {
+	Status        string
+	UpdatedBy     string
+	UpdatedDate   time.Time
+	TransactionId string
+}
+
+type StatedIncome struct {
+	ApplicationNumber string
+	MonthlyIncome     float64
+	StatedDate        time.Time
+}
+
+type BorrowerProfile struct {
+	Age           int
+	MonthlyIncome float64
+	CreditScore   int
+}
+
+type BorrowerExposure struct {
+	BorrowerId           string
+	ActiveLoans          int
+	NonPerformingLoans   int
+	TotalSanctioned      float64
+	OutstandingPrincipal float64
+	OverdueAmount        float64
+	ContingentLiability  float64
+	InvokedGuarantees    float64
+	Loans                []LoanExposure
+	GuaranteedLoans      []LoanExposure
+}
+
+type LoanExposure struct {
+	ApplicationNumber    string
+	LenderId             int
+	Status               int
+	SanctionedAmount     float64
+	OutstandingPrincipal float64
+	OverdueAmount        float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) UpdateKYCStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting borrower id and KYC status")
+	}
+	if args[1] != KYC_PENDING && args[1] != KYC_VERIFIED && args[1] != KYC_REJECTED {
+		return nil, errors.New("Invalid KYC status")
+	}
+
+	borrower, err := t.GetBorrowerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// A lender can only vouch for a borrower it has quoted
+	if caller.Role != ADMIN {
+		var hasBid bool = false
+		for i := 0; i < len(borrower.Applications) && !hasBid; i++ {
+			applicationDetails, err := t.GetApplication(stub, borrower.Applications[i])
+			hasBid = err == nil && t.HasLenderBid(applicationDetails, caller.LenderId)
+		}
+		if !hasBid {
+			return nil, errors.New("Access denied to borrower " + borrower.BorrowerId)
+		}
+	}
+
+	// Every change is kept so the status can be traced back to whoever set it
+	borrower.KYCStatus = args[1]
+	borrower.KYCUpdatedBy = caller.Username
+	borrower.KYCUpdatedDate = t.GetTransactionTime(stub)
+	borrower.UpdatedDate = borrower.KYCUpdatedDate
+	borrower.KYCHistory = append(borrower.KYCHistory, KYCStatusChange{Status: args[1], UpdatedBy: caller.Username, UpdatedDate: borrower.KYCUpdatedDate, TransactionId: stub.GetTxID()})
+
+	err = t.SaveBorrower(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(borrower)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetBorrower(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting borrower id")
+	}
+
+	borrower, caller, err := t.GetAccessibleBorrower(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(t.MaskPII(stub, caller, borrower))
+}
+
+func (t *SmartLendingChaincode) GetBorrowerLoans(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting borrower id")
+	}
+
+	borrower, caller, err := t.GetAccessibleBorrower(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Dealers get only the applications which they have originated
+	var applications []LoanApplication
+	for i := 0; i < len(borrower.Applications); i++ {
+		applicationDetails, err := t.GetApplication(stub, borrower.Applications[i])
+		if err != nil {
+			continue
+		}
+		if t.CheckApplicationViewAccess(caller, applicationDetails) != nil {
+			continue
+		}
+		applications = append(applications, t.FilterApplicationForCaller(stub, caller, applicationDetails))
+	}
+
+	return json.Marshal(applications)
+}
+
+func (t *SmartLendingChaincode) GetBorrowerExposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting borrower id")
+	}
+
+	borrower, _, err := t.GetAccessibleBorrower(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Consolidate the exposure across all the booked loans of the borrower
+	var exposure BorrowerExposure
+	exposure.BorrowerId = borrower.BorrowerId
+	for i := 0; i < len(borrower.Applications); i++ {
+		applicationDetails, err := t.GetApplication(stub, borrower.Applications[i])
+		if err != nil || !t.IsActiveLoan(applicationDetails) || t.IsPendingParty(applicationDetails, borrower.BorrowerId) {
+			continue
+		}
+
+		winningBid, _ := t.GetWinningBid(applicationDetails)
+		var loanExposure LoanExposure
+		loanExposure.ApplicationNumber = applicationDetails.ApplicationNumber
+		loanExposure.LenderId = t.GetServicingLenderId(applicationDetails, t.GetTransactionTime(stub))
+		loanExposure.Status = applicationDetails.Status
+		loanExposure.SanctionedAmount = winningBid.SanctionedAmount
+		loanExposure.OutstandingPrincipal = t.GetOutstandingPrincipal(applicationDetails)
+		loanExposure.OverdueAmount = t.GetOverdueAmount(applicationDetails)
+
+		exposure.ActiveLoans++
+		if applicationDetails.Status == STATE_NON_PERFORMING {
+			exposure.NonPerformingLoans++
+		}
+		exposure.TotalSanctioned = exposure.TotalSanctioned + loanExposure.SanctionedAmount
+		exposure.OutstandingPrincipal = exposure.OutstandingPrincipal + loanExposure.OutstandingPrincipal
+		exposure.OverdueAmount = exposure.OverdueAmount + loanExposure.OverdueAmount
+		exposure.Loans = append(exposure.Loans, loanExposure)
+	}
+
+	// Guaranteed loans are a contingent liability until the guarantee is invoked
+	for i := 0; i < len(borrower.GuaranteedApplications); i++ {
+		applicationDetails, err := t.GetApplication(stub, borrower.GuaranteedApplications[i])
+		if err != nil || !t.IsActiveLoan(applicationDetails) || t.IsPendingParty(applicationDetails, borrower.BorrowerId) {
+			continue
+		}
+
+		winningBid, _ := t.GetWinningBid(applicationDetails)
+		var loanExposure LoanExposure
+		loanExposure.ApplicationNumber = applicationDetails.ApplicationNumber
+		loanExposure.LenderId = t.GetServicingLenderId(applicationDetails, t.GetTransactionTime(stub))
+		loanExposure.Status = applicationDetails.Status
+		loanExposure.SanctionedAmount = winningBid.SanctionedAmount
+		loanExposure.OutstandingPrincipal = t.GetOutstandingPrincipal(applicationDetails)
+		loanExposure.OverdueAmount = t.GetOverdueAmount(applicationDetails)
+
+		var invoked bool = false
+		for j := 0; j < len(applicationDetails.Parties); j++ {
+			party := applicationDetails.Parties[j]
+			if party.BorrowerId == borrower.BorrowerId && party.Role == PARTY_GUARANTOR && party.IsLiable {
+				exposure.InvokedGuarantees = exposure.InvokedGuarantees + party.LiabilityAmount
+				invoked = true
+			}
+		}
+		if !invoked {
+			exposure.ContingentLiability = exposure.ContingentLiability + loanExposure.OutstandingPrincipal
+		}
+		exposure.GuaranteedLoans = append(exposure.GuaranteedLoans, loanExposure)
+	}
+
+	return json.Marshal(exposure)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) RegisterBorrower(stub shim.ChaincodeStubInterface, username string, applicationNumber string, partyRole string, ssnHash string, profile BorrowerProfile, dataKeyId string, encryptedPII string) (Borrower, error) {
+
+	var borrower Borrower
+	ssnHash, err := t.ParseSSNHash(ssnHash)
+	if err != nil {
+		return borrower, err
+	}
+	if encryptedPII != "" {
+		_, err = base64.StdEncoding.DecodeString(encryptedPII)
+		if err != nil {
+			return borrower, errors.New("Encrypted borrower details must be base64 encoded")
+		}
+	}
+
+	// Repeat customers are found through the hash of their SSN
+	bytes, err := stub.GetState(SSN_INDEX_PREFIX + ssnHash)
+	if err != nil {
+		return borrower, err
+	}
+	if bytes == nil {
+		if dataKeyId == "" || encryptedPII == "" {
+			return borrower, errors.New("A new borrower needs the id of their data key and their details encrypted under it")
+		}
+		sequence, err := t.GetNextSequence(stub, BORROWER_SEQUENCE)
+		if err != nil {
+			return borrower, err
+		}
+		borrower.BorrowerId = fmt.Sprintf("BRW%06d", sequence)
+		borrower.Username = username
+		borrower.SSNHash = ssnHash
+		borrower.PIIStatus = PII_AVAILABLE
+		borrower.KYCStatus = KYC_PENDING
+		borrower.CreatedDate = t.GetTransactionTime(stub)
+
+		err = stub.PutState(SSN_INDEX_PREFIX+ssnHash, []byte(borrower.BorrowerId))
+		if err != nil {
+			return borrower, err
+		}
+	} else {
+		borrower, err = t.GetBorrowerDetails(stub, string(bytes))
+		if err != nil {
+			return borrower, err
+		}
+		if borrower.Username != username {
+			return borrower, errors.New("SSN is registered to another borrower")
+		}
+	}
+
+	// Details resubmitted by the client replace the ones on file along with the key they are encrypted under
+	if encryptedPII != "" {
+		if dataKeyId != "" {
+			borrower.DataKeyId = dataKeyId
+		}
+		borrower.EncryptedPII = encryptedPII
+	}
+
+	// The profile always reflects the latest application while the income stated on each one is kept
+	borrower.Profile = profile
+	borrower.StatedIncomes = append(borrower.StatedIncomes, StatedIncome{ApplicationNumber: applicationNumber, MonthlyIncome: profile.MonthlyIncome, StatedDate: t.GetTransactionTime(stub)})
+	if partyRole == PARTY_GUARANTOR {
+		borrower.GuaranteedApplications = append(borrower.GuaranteedApplications, applicationNumber)
+	} else {
+		borrower.Applications = append(borrower.Applications, applicationNumber)
+	}
+	borrower.UpdatedDate = t.GetTransactionTime(stub)
+
+	err = t.SaveBorrower(stub, borrower)
+	return borrower, err
+}
+
+func (t *SmartLendingChaincode) GetBorrowerDetails(stub shim.ChaincodeStubInterface, borrowerId string) (Borrower, error) {
+
+	var borrower Borrower
+	bytes, err := stub.GetState(BORROWER_PREFIX + borrowerId)
+	if err != nil {
+		return borrower, err
+	}
+	if bytes == nil {
+		return borrower, errors.New("Could not find borrower")
+	}
+	err = json.Unmarshal(bytes, &borrower)
+	return borrower, err
+}
+
+// No new lending decision can be taken on the profile of a borrower whose data has been erased
+func (t *SmartLendingChaincode) GetBorrowerProfile(stub shim.ChaincodeStubInterface, borrowerId string) (BorrowerProfile, error) {
+
+	borrower, err := t.GetBorrowerDetails(stub, borrowerId)
+	if err != nil {
+		return borrower.Profile, err
+	}
+	if borrower.PIIStatus == PII_ERASED {
+		return borrower.Profile, errors.New("Borrower data has been erased")
+	}
+	return borrower.Profile, nil
+}
+
+func (t *SmartLendingChaincode) SaveBorrower(stub shim.ChaincodeStubInterface, borrower Borrower) error {
+
+	bytes, err := json.Marshal(borrower)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(BORROWER_PREFIX+borrower.BorrowerId, bytes)
+}
+
+func (t *SmartLendingChaincode) GetAccessibleBorrower(stub shim.ChaincodeStubInterface, borrowerId string) (Borrower, CallerDetails, error) {
+
+	borrower, err := t.GetBorrowerDetails(stub, borrowerId)
+	if err != nil {
+		return borrower, CallerDetails{}, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return borrower, caller, err
+	}
+
+	if caller.Role == ADMIN {
+		return borrower, caller, nil
+	} else if caller.Role == BORROWER && borrower.Username == caller.Username {
+		return borrower, caller, nil
+	} else if caller.Role == DEALER || caller.Role == LENDER {
+		// Dealers and lenders can see the borrowers of the applications they can see
+		for i := 0; i < len(borrower.Applications); i++ {
+			applicationDetails, err := t.GetApplication(stub, borrower.Applications[i])
+			if err == nil && t.CheckApplicationViewAccess(caller, applicationDetails) == nil {
+				return borrower, caller, nil
+			}
+		}
+	}
+	return borrower, caller, errors.New("Access denied to borrower " + borrowerId)
+}
+
+func (t *SmartLendingChaincode) IsActiveLoan(applicationDetails LoanApplication) bool {
+	_, booked := t.GetWinningBid(applicationDetails)
+	return booked && applicationDetails.Status != STATE_CLOSED
+}
+
+func (t *SmartLendingChaincode) GetOutstandingPrincipal(applicationDetails LoanApplication) float64 {
+
+	// Until the schedule is generated the borrower owes whatever has been paid out
+	if len(applicationDetails.RepaymentSchedule) == 0 {
+		return applicationDetails.DisbursedAmount
+	}
+	var outstandingPrincipal float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus != STATE_RECOVERED {
+			outstandingPrincipal = outstandingPrincipal + applicationDetails.RepaymentSchedule[i].PrincipalAmount
+		}
+	}
+	return outstandingPrincipal
+}
+
+func (t *SmartLendingChaincode) GetOverdueAmount(applicationDetails LoanApplication) float64 {
+	var overdueAmount float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus == STATE_MISSED {
+			overdueAmount = overdueAmount + applicationDetails.RepaymentSchedule[i].TotalEMI
+		}
+	}
+	return overdueAmount
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Dealers - Keys
+//==============================================================================================================================
+const DEALER_PREFIX = "DEALER_"
+const DEALER_AGREEMENT_PREFIX = "DEALERAGREEMENT_"
+
+//==============================================================================================================================
+//	Status types - Dealer
+//==============================================================================================================================
+const DEALER_ACTIVE = "ACTIVE"
+const DEALER_SUSPENDED = "SUSPENDED"
+
+//==============================================================================================================================
+//	Status types - Dealer commission
+//==============================================================================================================================
+const COMMISSION_ACCRUED = "ACCRUED"
+const COMMISSION_SETTLED = "SETTLED"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type Dealer struct {
+	DealerId           string
+	Name               string
+	RegistrationNumber string
+	Status             string
+	Inventory          []string
+	Applications       []string
+	Commissions        []DealerCommission
+	RegisteredBy       string
+	RegisteredDate     time.Time
+	UpdatedDate        time.Time
+}
+
+type DealerAgreement struct {
+	LenderId          int
+	DealerId          string
+	CommissionPercent float64
+	UpdatedDate       time.Time
+}
+
+type DealerCommission struct {
+	ApplicationNumber   string
+	LenderId            int
+	DisbursedAmount     float64
+	CommissionPercent   float64
+	Amount              float64
+	Status              string
+	AccruedDate         time.Time
+	AccrualTxId         string
+	SettledDate         time.Time
+	SettlementReference string
+}
+
+type DealerStatement struct {
+	DealerId     string
+	Name         string
+	Status       string
+	TotalAccrued float64
+	TotalSettled float64
+	Outstanding  float64
+	Commissions  []DealerCommission
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the dealer id, which is the username on the dealer's certificate, the name and the registration number
+func (t *SmartLendingChaincode) RegisterDealer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dealer id, name and registration number")
+	}
+	if args[0] == "" || args[1] == "" {
+		return nil, errors.New("Dealer id and name are required")
+	}
+
+	bytes, err := stub.GetState(DEALER_PREFIX + args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		return nil, errors.New("Dealer already registered")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// A dealer matching the blocklists is onboarded suspended until compliance clears it
+	screening, err := t.ScreenName(stub, SCREENING_SUBJECT_DEALER, args[0], "", args[1])
+	if err != nil {
+		return nil, err
+	}
+	currentTime := t.GetTransactionTime(stub)
+	dealer := Dealer{DealerId: args[0], Name: args[1], RegistrationNumber: args[2], Status: DEALER_ACTIVE, RegisteredBy: caller.Username, RegisteredDate: currentTime, UpdatedDate: currentTime}
+	if screening.Outcome != SCREENING_CLEAR {
+		dealer.Status = DEALER_SUSPENDED
+	}
+	err = t.SaveDealer(stub, dealer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(dealer)
+}
+
+func (t *SmartLendingChaincode) UpdateDealerStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dealer id and status")
+	}
+	if args[1] != DEALER_ACTIVE && args[1] != DEALER_SUSPENDED {
+		return nil, errors.New("Invalid dealer status")
+	}
+
+	dealer, err := t.GetDealerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	dealer.Status = args[1]
+	dealer.UpdatedDate = t.GetTransactionTime(stub)
+
+	err = t.SaveDealer(stub, dealer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(dealer)
+}
+
+// Arguments are the lender id, dealer id and the commission in percent of the loan amount
+func (t *SmartLendingChaincode) SetDealerAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, dealer id and commission percent")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.GetDealerDetails(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	commissionPercent, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || commissionPercent < 0 || commissionPercent > 100 {
+		return nil, errors.New("Invalid commission percent")
+	}
+
+	agreement := DealerAgreement{LenderId: lenderId, DealerId: args[1], CommissionPercent: commissionPercent, UpdatedDate: t.GetTransactionTime(stub)}
+	bytes, err := json.Marshal(agreement)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(t.GetDealerAgreementKey(lenderId, args[1]), bytes)
+
+	return bytes, err
+}
+
+// Arguments are the lender id, dealer id and the payment reference, all accrued commissions of the lender are settled
+func (t *SmartLendingChaincode) SettleDealerCommission(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, dealer id and settlement reference")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	if args[2] == "" {
+		return nil, errors.New("Settlement reference is required")
+	}
+
+	dealer, err := t.GetDealerDetails(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var settled []DealerCommission
+	currentTime := t.GetTransactionTime(stub)
+	for i := 0; i < len(dealer.Commissions); i++ {
+		if dealer.Commissions[i].LenderId != lenderId || dealer.Commissions[i].Status != COMMISSION_ACCRUED {
+			continue
+		}
+		dealer.Commissions[i].Status = COMMISSION_SETTLED
+		dealer.Commissions[i].SettledDate = currentTime
+		dealer.Commissions[i].SettlementReference = args[2]
+		settled = append(settled, dealer.Commissions[i])
+	}
+	if len(settled) == 0 {
+		return nil, errors.New("No accrued commission to settle")
+	}
+
+	dealer.UpdatedDate = currentTime
+	err = t.SaveDealer(stub, dealer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(settled)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetDealer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dealer id")
+	}
+
+	dealer, err := t.GetDealerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Commissions are visible through the dealer statement only
+	dealer.Commissions = nil
+	return json.Marshal(dealer)
+}
+
+func (t *SmartLendingChaincode) GetDealerInventory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dealer id")
+	}
+
+	dealer, err := t.GetDealerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var inventory []VehicleAsset
+	for i := 0; i < len(dealer.Inventory); i++ {
+		vehicle, err := t.GetVehicleDetails(stub, dealer.Inventory[i])
+		if err != nil {
+			return nil, err
+		}
+		inventory = append(inventory, vehicle)
+	}
+	return json.Marshal(inventory)
+}
+
+func (t *SmartLendingChaincode) GetDealerStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dealer id")
+	}
+
+	dealer, err := t.GetDealerDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Dealers see their own statement while lenders see only the commissions they owe
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role == DEALER && caller.Username != dealer.DealerId {
+		return nil, errors.New("Access denied to dealer " + dealer.DealerId)
+	}
+
+	statement := DealerStatement{DealerId: dealer.DealerId, Name: dealer.Name, Status: dealer.Status}
+	for i := 0; i < len(dealer.Commissions); i++ {
+		commission := dealer.Commissions[i]
+		if caller.Role == LENDER && commission.LenderId != caller.LenderId {
+			continue
+		}
+		statement.Commissions = append(statement.Commissions, commission)
+		statement.TotalAccrued = statement.TotalAccrued + commission.Amount
+		if commission.Status == COMMISSION_SETTLED {
+			statement.TotalSettled = statement.TotalSettled + commission.Amount
+		}
+	}
+	statement.Outstanding = statement.TotalAccrued - statement.TotalSettled
+
+	return json.Marshal(statement)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetDealerDetails(stub shim.ChaincodeStubInterface, dealerId string) (Dealer, error) {
+
+	var dealer Dealer
+	bytes, err := stub.GetState(DEALER_PREFIX + dealerId)
+	if err != nil {
+		return dealer, err
+	}
+	if bytes == nil {
+		return dealer, errors.New("Could not find dealer " + dealerId)
+	}
+	err = json.Unmarshal(bytes, &dealer)
+	return dealer, err
+}
+
+func (t *SmartLendingChaincode) SaveDealer(stub shim.ChaincodeStubInterface, dealer Dealer) error {
+
+	bytes, err := json.Marshal(dealer)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(DEALER_PREFIX+dealer.DealerId, bytes)
+}
+
+func (t *SmartLendingChaincode) GetActiveDealer(stub shim.ChaincodeStubInterface, dealerId string) (Dealer, error) {
+
+	dealer, err := t.GetDealerDetails(stub, dealerId)
+	if err != nil {
+		return dealer, err
+	}
+	if dealer.Status != DEALER_ACTIVE {
+		return dealer, errors.New("Dealer " + dealerId + " is not active")
+	}
+	return dealer, nil
+}
+
+func (t *SmartLendingChaincode) GetDealerAgreementKey(lenderId int, dealerId string) string {
+	return DEALER_AGREEMENT_PREFIX + strconv.Itoa(lenderId) + "_" + dealerId
+}
+
+func (t *SmartLendingChaincode) AddToDealerInventory(stub shim.ChaincodeStubInterface, dealerId string, vin string) error {
+
+	dealer, err := t.GetActiveDealer(stub, dealerId)
+	if err != nil {
+		return err
+	}
+	dealer.Inventory = append(dealer.Inventory, vin)
+	return t.SaveDealer(stub, dealer)
+}
+
+func (t *SmartLendingChaincode) AddToDealerApplications(stub shim.ChaincodeStubInterface, dealerId string, applicationNumber string) error {
+
+	dealer, err := t.GetActiveDealer(stub, dealerId)
+	if err != nil {
+		return err
+	}
+	dealer.Applications = append(dealer.Applications, applicationNumber)
+	return t.SaveDealer(stub, dealer)
+}
+
+func (t *SmartLendingChaincode) AccrueDealerCommission(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, lenderId int, disbursedAmount float64) error {
+
+	// Only dealer originated loans earn a commission
+	if applicationDetails.DealerId == "" {
+		return nil
+	}
+
+	dealer, err := t.GetDealerDetails(stub, applicationDetails.DealerId)
+	if err != nil {
+		return err
+	}
+
+	// The financed vehicle leaves the dealer's inventory
+	var inventory []string
+	for i := 0; i < len(dealer.Inventory); i++ {
+		if dealer.Inventory[i] != applicationDetails.VIN {
+			inventory = append(inventory, dealer.Inventory[i])
+		}
+	}
+	dealer.Inventory = inventory
+
+	// No commission is due without an agreement between the lender and the dealer
+	bytes, err := stub.GetState(t.GetDealerAgreementKey(lenderId, dealer.DealerId))
+	if err != nil {
+		return err
+	}
+	if bytes != nil {
+		var agreement DealerAgreement
+		err = json.Unmarshal(bytes, &agreement)
+		if err != nil {
+			return err
+		}
+
+		var commission DealerCommission
+		commission.ApplicationNumber = applicationDetails.ApplicationNumber
+		commission.LenderId = lenderId
+		commission.DisbursedAmount = disbursedAmount
+		commission.CommissionPercent = agreement.CommissionPercent
+		commission.Amount = math.Floor(disbursedAmount*agreement.CommissionPercent) / 100
+		commission.Status = COMMISSION_ACCRUED
+		commission.AccruedDate = t.GetTransactionTime(stub)
+		commission.AccrualTxId = stub.GetTxID()
+		dealer.Commissions = append(dealer.Commissions, commission)
+	}
+
+	dealer.UpdatedDate = t.GetTransactionTime(stub)
+	return t.SaveDealer(stub, dealer)
+}
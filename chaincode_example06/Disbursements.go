@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Disbursements - Date format
+//==============================================================================================================================
+const DISBURSEMENT_DATE_FORMAT = "2006-01-02"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type Disbursement struct {
+	TrancheNumber    int
+	Amount           float64
+	Payee            string
+	Reference        string
+	DisbursementDate time.Time
+	IsFinal          bool
+	RecordedBy       string
+	TransactionId    string
+	RecordedDate     time.Time
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number, amount, payment reference, the disbursement date as YYYY-MM-DD and optionally
+// whether this is the final tranche. The loan is fully disbursed once the sanctioned amount is paid out or the lender
+// marks a tranche as final, after which the repayment schedule is generated from the disbursement date
+func (t *SmartLendingChaincode) RecordDisbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, amount, reference, disbursement date and optionally the final tranche flag")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the winning lender pays out the loan
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	winningBid, found := t.GetWinningBid(applicationDetails)
+	if !found {
+		return nil, errors.New("Loan has not been booked")
+	}
+	err = t.CheckLenderAccess(caller, winningBid.LenderId)
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_BID_ACCEPTED && applicationDetails.Status != STATE_PARTIALLY_DISBURSED {
+		return nil, errors.New("Loan is not pending disbursement")
+	}
+
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Invalid amount")
+	}
+	if applicationDetails.DisbursedAmount+amount > winningBid.SanctionedAmount {
+		return nil, errors.New("Disbursement exceeds the sanctioned amount")
+	}
+	if args[2] == "" {
+		return nil, errors.New("Payment reference is required")
+	}
+	for i := 0; i < len(applicationDetails.Disbursements); i++ {
+		if applicationDetails.Disbursements[i].Reference == args[2] {
+			return nil, errors.New("Payment reference has already been recorded")
+		}
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	disbursementDate, err := time.Parse(DISBURSEMENT_DATE_FORMAT, args[3])
+	if err != nil {
+		return nil, errors.New("Invalid disbursement date")
+	}
+	if disbursementDate.After(currentTime) {
+		return nil, errors.New("Disbursement date cannot be in the future")
+	}
+	if len(applicationDetails.Disbursements) > 0 && disbursementDate.Before(applicationDetails.Disbursements[len(applicationDetails.Disbursements)-1].DisbursementDate) {
+		return nil, errors.New("Disbursement date is before the previous tranche")
+	}
+	var isFinal bool = false
+	if len(args) == 5 {
+		isFinal, err = strconv.ParseBool(args[4])
+		if err != nil {
+			return nil, errors.New("Invalid final tranche flag")
+		}
+	}
+
+	// Dealer originated loans are paid out to the dealer and others to the borrower
+	var disbursement Disbursement
+	disbursement.TrancheNumber = len(applicationDetails.Disbursements) + 1
+	disbursement.Amount = amount
+	disbursement.Payee = applicationDetails.BorrowerUsername
+	if applicationDetails.DealerId != "" {
+		disbursement.Payee = applicationDetails.DealerId
+	}
+	disbursement.Reference = args[2]
+	disbursement.DisbursementDate = disbursementDate
+	disbursement.RecordedBy = caller.Username
+	disbursement.TransactionId = stub.GetTxID()
+	disbursement.RecordedDate = currentTime
+
+	applicationDetails.DisbursedAmount = applicationDetails.DisbursedAmount + amount
+	disbursement.IsFinal = isFinal || applicationDetails.DisbursedAmount == winningBid.SanctionedAmount
+	applicationDetails.Disbursements = append(applicationDetails.Disbursements, disbursement)
+
+	// Post the payout to the ledgers of the lenders funding the loan
+	err = t.PostDisbursement(stub, applicationDetails, disbursement)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accrue the dealer's commission on the amount paid out
+	err = t.AccrueDealerCommission(stub, applicationDetails, winningBid.LenderId, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repayments start once the loan is fully disbursed, anchored to the final disbursement date
+	if disbursement.IsFinal {
+		applicationDetails.DisbursementDate = disbursementDate
+		applicationDetails.RepaymentSchedule = t.GenerateRepaymentSchedule(winningBid, applicationDetails.DisbursedAmount, disbursementDate)
+		applicationDetails.Status = STATE_PERFORMING
+	} else {
+		applicationDetails.Status = STATE_PARTIALLY_DISBURSED
+	}
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) IsLoanDisbursed(applicationDetails LoanApplication) bool {
+	return applicationDetails.Status != STATE_BID_ACCEPTED && applicationDetails.Status != STATE_PARTIALLY_DISBURSED
+}
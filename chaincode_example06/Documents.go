@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Documents - Keys
+//==============================================================================================================================
+const DOCUMENT_PREFIX = "DOCUMENT_"
+const DOCUMENT_SEQUENCE = "_documentsequence"
+
+//==============================================================================================================================
+//	 Documents - Types and verification statuses
+//==============================================================================================================================
+const DOCUMENT_ID_PROOF = "ID_PROOF"
+const DOCUMENT_ADDRESS_PROOF = "ADDRESS_PROOF"
+const DOCUMENT_INCOME_PROOF = "INCOME_PROOF"
+const DOCUMENT_DEALER_INVOICE = "DEALER_INVOICE"
+const DOCUMENT_INSURANCE = "INSURANCE"
+
+const DOCUMENT_PENDING = "PENDING"
+const DOCUMENT_VERIFIED = "VERIFIED"
+const DOCUMENT_REJECTED = "REJECTED"
+
+var DOCUMENT_TYPES = []string{DOCUMENT_ID_PROOF, DOCUMENT_ADDRESS_PROOF, DOCUMENT_INCOME_PROOF, DOCUMENT_DEALER_INVOICE, DOCUMENT_INSURANCE}
+
+// Identity documents belong to the borrower and are reused across applications
+var KYC_DOCUMENT_TYPES = []string{DOCUMENT_ID_PROOF, DOCUMENT_ADDRESS_PROOF}
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+// Only the SHA-256 hash of the file is kept on the ledger, the file itself is stored off-chain
+type Document struct {
+	DocumentId        string
+	ApplicationNumber string
+	BorrowerId        string
+	DocumentType      string
+	Hash              string
+	Issuer            string
+	UploadedBy        string
+	UploaderRole      string
+	UploadedDate      time.Time
+	Verifications     []DocumentVerification
+	TransactionId     string
+}
+
+// Each lender verifies a document for itself
+type DocumentVerification struct {
+	LenderId     int
+	Status       string
+	VerifiedBy   string
+	VerifiedDate time.Time
+	Comment      string
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number, document type, hex encoded SHA-256 hash of the file and the issuer
+func (t *SmartLendingChaincode) AddDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, document type, hash and issuer")
+	}
+	if !t.ContainsString(DOCUMENT_TYPES, args[1]) {
+		return nil, errors.New("Invalid document type")
+	}
+	hash := strings.ToLower(args[2])
+	decodedHash, err := hex.DecodeString(hash)
+	if err != nil || len(decodedHash) != 32 {
+		return nil, errors.New("Hash must be a hex encoded SHA-256 digest")
+	}
+	if args[3] == "" {
+		return nil, errors.New("Issuer is required")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same file cannot be recorded twice against an application unless a lender has rejected it
+	documents, err := t.GetDocuments(stub, applicationDetails.Documents)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(documents); i++ {
+		if documents[i].Hash == hash && !t.IsDocumentRejected(documents[i]) {
+			return nil, errors.New("Document already recorded as " + documents[i].DocumentId)
+		}
+	}
+
+	sequence, err := t.GetNextSequence(stub, DOCUMENT_SEQUENCE)
+	if err != nil {
+		return nil, err
+	}
+	document := Document{DocumentId: fmt.Sprintf("DOC%06d", sequence), ApplicationNumber: applicationDetails.ApplicationNumber, BorrowerId: applicationDetails.BorrowerId, DocumentType: args[1], Hash: hash, Issuer: args[3], UploadedBy: caller.Username, UploaderRole: caller.Role, UploadedDate: t.GetTransactionTime(stub), TransactionId: stub.GetTxID()}
+	err = t.SaveDocument(stub, document)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationDetails.Documents = append(applicationDetails.Documents, document.DocumentId)
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	borrower, err := t.GetBorrowerDetails(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return nil, err
+	}
+	borrower.Documents = append(borrower.Documents, document.DocumentId)
+	borrower.UpdatedDate = document.UploadedDate
+	err = t.SaveBorrower(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(document)
+}
+
+// Arguments are the document id, VERIFIED or REJECTED and a comment. Each lender on the application decides
+// for itself and its decision is final, so a document it rejected has to be uploaded again
+func (t *SmartLendingChaincode) VerifyDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting document id, verification status and comment")
+	}
+	if args[1] != DOCUMENT_VERIFIED && args[1] != DOCUMENT_REJECTED {
+		return nil, errors.New("Invalid verification status")
+	}
+
+	document, err := t.GetDocument(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, document.ApplicationNumber)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+	status := t.GetDocumentStatus(document, caller.LenderId)
+	if status != DOCUMENT_PENDING {
+		return nil, errors.New("Document has already been " + strings.ToLower(status) + " by lender " + strconv.Itoa(caller.LenderId))
+	}
+	if document.UploadedBy == caller.Username {
+		return nil, errors.New("Documents cannot be verified by the user that uploaded them")
+	}
+
+	verification := DocumentVerification{LenderId: caller.LenderId, Status: args[1], VerifiedBy: caller.Username, VerifiedDate: t.GetTransactionTime(stub), Comment: args[2]}
+	document.Verifications = append(document.Verifications, verification)
+	err = t.SaveDocument(stub, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(document)
+}
+
+// Arguments are the lender id followed by the document types that must be verified before one of its bids
+// is confirmed, no types clears the requirement
+func (t *SmartLendingChaincode) SetRequiredDocuments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id and the required document types")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	var requiredDocuments []string
+	for i := 1; i < len(args); i++ {
+		if !t.ContainsString(DOCUMENT_TYPES, args[i]) {
+			return nil, errors.New("Invalid document type " + args[i])
+		}
+		if !t.ContainsString(requiredDocuments, args[i]) {
+			requiredDocuments = append(requiredDocuments, args[i])
+		}
+	}
+
+	product := t.GetLenderProduct(stub, lenderId)
+	product.RequiredDocuments = requiredDocuments
+
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(LENDER_PRODUCT_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetApplicationDocuments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationViewAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := t.GetDocuments(stub, applicationDetails.Documents)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(documents)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetDocument(stub shim.ChaincodeStubInterface, documentId string) (Document, error) {
+
+	var document Document
+	bytes, err := stub.GetState(DOCUMENT_PREFIX + documentId)
+	if err != nil {
+		return document, err
+	}
+	if bytes == nil {
+		return document, errors.New("Could not find document")
+	}
+	err = json.Unmarshal(bytes, &document)
+	return document, err
+}
+
+func (t *SmartLendingChaincode) SaveDocument(stub shim.ChaincodeStubInterface, document Document) error {
+
+	bytes, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(DOCUMENT_PREFIX+document.DocumentId, bytes)
+}
+
+func (t *SmartLendingChaincode) GetDocuments(stub shim.ChaincodeStubInterface, documentIds []string) ([]Document, error) {
+
+	var documents []Document
+	for i := 0; i < len(documentIds); i++ {
+		document, err := t.GetDocument(stub, documentIds[i])
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+func (t *SmartLendingChaincode) GetDocumentStatus(document Document, lenderId int) string {
+	for i := 0; i < len(document.Verifications); i++ {
+		if document.Verifications[i].LenderId == lenderId {
+			return document.Verifications[i].Status
+		}
+	}
+	return DOCUMENT_PENDING
+}
+
+func (t *SmartLendingChaincode) IsDocumentRejected(document Document) bool {
+	for i := 0; i < len(document.Verifications); i++ {
+		if document.Verifications[i].Status == DOCUMENT_REJECTED {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) ContainsString(values []string, value string) bool {
+	for i := 0; i < len(values); i++ {
+		if values[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) CheckRequiredDocuments(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, lenderId int) error {
+
+	product := t.GetLenderProduct(stub, lenderId)
+	if len(product.RequiredDocuments) == 0 {
+		return nil
+	}
+
+	// Identity documents verified on the borrower's earlier applications count as well
+	documentIds := applicationDetails.Documents
+	borrower, err := t.GetBorrowerDetails(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(borrower.Documents); i++ {
+		if !t.ContainsString(documentIds, borrower.Documents[i]) {
+			documentIds = append(documentIds, borrower.Documents[i])
+		}
+	}
+	documents, err := t.GetDocuments(stub, documentIds)
+	if err != nil {
+		return err
+	}
+
+	// Only the lender's own verifications count
+	for i := 0; i < len(product.RequiredDocuments); i++ {
+		var verified bool = false
+		for j := 0; j < len(documents) && !verified; j++ {
+			if documents[j].DocumentType != product.RequiredDocuments[i] || t.GetDocumentStatus(documents[j], lenderId) != DOCUMENT_VERIFIED {
+				continue
+			}
+			verified = documents[j].ApplicationNumber == applicationDetails.ApplicationNumber || t.ContainsString(KYC_DOCUMENT_TYPES, documents[j].DocumentType)
+		}
+		if !verified {
+			return errors.New("Lender requires a verified " + product.RequiredDocuments[i] + " document")
+		}
+	}
+	return nil
+}
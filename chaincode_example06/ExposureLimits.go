@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Exposure limits - Keys
+//==============================================================================================================================
+const EXPOSURE_LIMITS_PREFIX = "EXPOSURELIMITS_"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+// Limits are amounts of outstanding principal and undisbursed commitments, zero when the lender does not set the limit
+type ExposureLimits struct {
+	LenderId             int
+	MaxPortfolioExposure float64
+	MaxBorrowerExposure  float64
+	MaxDealerExposure    float64
+	MaxMakeModelExposure float64
+}
+
+type LenderExposure struct {
+	LenderId           int
+	Limits             ExposureLimits
+	PortfolioExposure  float64
+	BorrowerExposures  []ExposureConcentration
+	DealerExposures    []ExposureConcentration
+	MakeModelExposures []ExposureConcentration
+}
+
+type ExposureConcentration struct {
+	Key      string
+	Loans    int
+	Exposure float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the lender id and the portfolio, per borrower, per dealer and per make and model limits
+func (t *SmartLendingChaincode) SetExposureLimits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id and the portfolio, borrower, dealer and make and model limits")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	var amounts []float64
+	for i := 1; i < len(args); i++ {
+		amount, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || amount < 0 {
+			return nil, errors.New("Invalid exposure limit")
+		}
+		amounts = append(amounts, amount)
+	}
+
+	limits := ExposureLimits{LenderId: lenderId, MaxPortfolioExposure: amounts[0], MaxBorrowerExposure: amounts[1], MaxDealerExposure: amounts[2], MaxMakeModelExposure: amounts[3]}
+	bytes, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(EXPOSURE_LIMITS_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLenderExposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	lenderId, err := t.GetLedgerLenderId(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var exposure LenderExposure
+	exposure.LenderId = lenderId
+	exposure.Limits, err = t.GetExposureLimits(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil {
+			continue
+		}
+		loanExposure := t.GetLenderLoanExposure(applicationDetails, lenderId)
+		if loanExposure <= 0 {
+			continue
+		}
+		exposure.PortfolioExposure = t.RoundAmount(exposure.PortfolioExposure + loanExposure)
+		exposure.BorrowerExposures = t.AddConcentration(exposure.BorrowerExposures, applicationDetails.BorrowerId, loanExposure)
+		if applicationDetails.DealerId != "" {
+			exposure.DealerExposures = t.AddConcentration(exposure.DealerExposures, applicationDetails.DealerId, loanExposure)
+		}
+		exposure.MakeModelExposures = t.AddConcentration(exposure.MakeModelExposures, t.GetMakeModelKey(applicationDetails), loanExposure)
+	}
+
+	return json.Marshal(exposure)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetExposureLimits(stub shim.ChaincodeStubInterface, lenderId int) (ExposureLimits, error) {
+
+	limits := ExposureLimits{LenderId: lenderId}
+	bytes, err := stub.GetState(EXPOSURE_LIMITS_PREFIX + strconv.Itoa(lenderId))
+	if err != nil {
+		return limits, err
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &limits)
+	}
+	return limits, err
+}
+
+func (t *SmartLendingChaincode) GetMakeModelKey(applicationDetails LoanApplication) string {
+	return applicationDetails.Make + " " + applicationDetails.Model
+}
+
+func (t *SmartLendingChaincode) AddConcentration(concentrations []ExposureConcentration, key string, amount float64) []ExposureConcentration {
+
+	for i := 0; i < len(concentrations); i++ {
+		if concentrations[i].Key == key {
+			concentrations[i].Loans++
+			concentrations[i].Exposure = t.RoundAmount(concentrations[i].Exposure + amount)
+			return concentrations
+		}
+	}
+	return append(concentrations, ExposureConcentration{Key: key, Loans: 1, Exposure: t.RoundAmount(amount)})
+}
+
+func (t *SmartLendingChaincode) GetLenderLoanExposure(applicationDetails LoanApplication, lenderId int) float64 {
+
+	if applicationDetails.Status != STATE_BID_ACCEPTED && applicationDetails.Status != STATE_PARTIALLY_DISBURSED && applicationDetails.Status != STATE_PERFORMING && applicationDetails.Status != STATE_NON_PERFORMING {
+		return 0
+	}
+	winningBid, found := t.GetWinningBid(applicationDetails)
+	if !found {
+		return 0
+	}
+
+	// Until the schedule is generated the lender is committed to its share of the full sanction
+	if len(applicationDetails.RepaymentSchedule) == 0 {
+		participant, found := t.GetSyndicateShare(applicationDetails, lenderId)
+		if !found {
+			return 0
+		}
+		return winningBid.SanctionedAmount * participant.SharePercent / 100
+	}
+	return t.GetLenderOutstandingPrincipal(applicationDetails, lenderId)
+}
+
+func (t *SmartLendingChaincode) CheckExposureLimits(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, lenderId int, amount float64) error {
+
+	limits, err := t.GetExposureLimits(stub, lenderId)
+	if err != nil {
+		return err
+	}
+	if limits.MaxPortfolioExposure <= 0 && limits.MaxBorrowerExposure <= 0 && limits.MaxDealerExposure <= 0 && limits.MaxMakeModelExposure <= 0 {
+		return nil
+	}
+
+	// Add up the lender's existing exposure leaving out the application being checked
+	var portfolioExposure float64 = amount
+	var borrowerExposure float64 = amount
+	var dealerExposure float64 = amount
+	var makeModelExposure float64 = amount
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(applicationIndex); i++ {
+		if applicationIndex[i] == applicationDetails.ApplicationNumber {
+			continue
+		}
+		otherApplication, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil {
+			continue
+		}
+		loanExposure := t.GetLenderLoanExposure(otherApplication, lenderId)
+		if loanExposure <= 0 {
+			continue
+		}
+		portfolioExposure = portfolioExposure + loanExposure
+		if otherApplication.BorrowerId == applicationDetails.BorrowerId {
+			borrowerExposure = borrowerExposure + loanExposure
+		}
+		if applicationDetails.DealerId != "" && otherApplication.DealerId == applicationDetails.DealerId {
+			dealerExposure = dealerExposure + loanExposure
+		}
+		if t.GetMakeModelKey(otherApplication) == t.GetMakeModelKey(applicationDetails) {
+			makeModelExposure = makeModelExposure + loanExposure
+		}
+	}
+
+	if limits.MaxPortfolioExposure > 0 && t.RoundAmount(portfolioExposure) > limits.MaxPortfolioExposure {
+		return errors.New("Lender portfolio exposure limit exceeded")
+	}
+	if limits.MaxBorrowerExposure > 0 && t.RoundAmount(borrowerExposure) > limits.MaxBorrowerExposure {
+		return errors.New("Lender borrower exposure limit exceeded")
+	}
+	if applicationDetails.DealerId != "" && limits.MaxDealerExposure > 0 && t.RoundAmount(dealerExposure) > limits.MaxDealerExposure {
+		return errors.New("Lender dealer concentration limit exceeded")
+	}
+	if limits.MaxMakeModelExposure > 0 && t.RoundAmount(makeModelExposure) > limits.MaxMakeModelExposure {
+		return errors.New("Lender make and model concentration limit exceeded")
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) ApplyExposureLimits(stub shim.ChaincodeStubInterface, bidDetails BiddingDetails, applicationDetails LoanApplication) BiddingDetails {
+
+	if bidDetails.ApplicationAcceptStatus != LENDER_ACCEPT_APPLICATION {
+		return bidDetails
+	}
+
+	// The lender declines rather than quote beyond its risk appetite
+	err := t.CheckExposureLimits(stub, applicationDetails, bidDetails.LenderId, bidDetails.SanctionedAmount)
+	if err != nil {
+		return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: err.Error()}
+	}
+	return bidDetails
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Fraud checks - Keys and events
+//==============================================================================================================================
+const FRAUD_RULE_SETTINGS = "_fraudrulesettings"
+const APPLICATION_FLAGGED_EVENT = "APPLICATION_FLAGGED"
+
+//==============================================================================================================================
+//	 Fraud checks - Rule ids
+//==============================================================================================================================
+const FRAUD_DUPLICATE_SSN = "FR001"
+const FRAUD_VIN_FINANCED = "FR002"
+const FRAUD_DEALER_VELOCITY = "FR003"
+const FRAUD_INCOME_MISMATCH = "FR004"
+const FRAUD_SCREENING_MATCH = "FR005"
+
+//==============================================================================================================================
+//	 Fraud checks - Review decisions
+//==============================================================================================================================
+const REVIEW_CLEARED = "CLEARED"
+const REVIEW_DECLINED = "DECLINED"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type FraudRuleSettings struct {
+	DuplicateWindowHours   int
+	DealerWindowHours      int
+	MaxDealerApplications  int
+	IncomeLookbackDays     int
+	IncomeTolerancePercent float64
+}
+
+type FraudFlag struct {
+	RuleId      string
+	Description string
+}
+
+type FraudReview struct {
+	Decision      string
+	Comment       string
+	ReviewedBy    string
+	ReviewDate    time.Time
+	TransactionId string
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the duplicate SSN window in hours, the dealer window in hours, the maximum applications a dealer can
+// file in that window, the income lookback in days and the tolerated income difference in percent. A window,
+// maximum or lookback of zero switches the rule off
+func (t *SmartLendingChaincode) SetFraudRuleSettings(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting duplicate window, dealer window, maximum dealer applications, income lookback and income tolerance")
+	}
+
+	var settings FraudRuleSettings
+	var err error
+	settings.DuplicateWindowHours, err = strconv.Atoi(args[0])
+	if err != nil || settings.DuplicateWindowHours < 0 {
+		return nil, errors.New("Invalid duplicate window")
+	}
+	settings.DealerWindowHours, err = strconv.Atoi(args[1])
+	if err != nil || settings.DealerWindowHours < 0 {
+		return nil, errors.New("Invalid dealer window")
+	}
+	settings.MaxDealerApplications, err = strconv.Atoi(args[2])
+	if err != nil || settings.MaxDealerApplications < 0 {
+		return nil, errors.New("Invalid maximum dealer applications")
+	}
+	settings.IncomeLookbackDays, err = strconv.Atoi(args[3])
+	if err != nil || settings.IncomeLookbackDays < 0 {
+		return nil, errors.New("Invalid income lookback")
+	}
+	settings.IncomeTolerancePercent, err = strconv.ParseFloat(args[4], 64)
+	if err != nil || settings.IncomeTolerancePercent < 0 {
+		return nil, errors.New("Invalid income tolerance")
+	}
+
+	bytes, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(FRAUD_RULE_SETTINGS, bytes)
+
+	return bytes, err
+}
+
+// Arguments are the application number, the decision and a comment
+func (t *SmartLendingChaincode) ReviewFlaggedApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, decision and comment")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_MANUAL_REVIEW {
+		return nil, errors.New("Application is not awaiting review")
+	}
+	if args[1] != REVIEW_CLEARED && args[1] != REVIEW_DECLINED {
+		return nil, errors.New("Invalid review decision")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationDetails.FraudReview = FraudReview{Decision: args[1], Comment: args[2], ReviewedBy: caller.Username, ReviewDate: t.GetTransactionTime(stub), TransactionId: stub.GetTxID()}
+
+	// A cleared application goes out to the lenders as it would have without the flags, a sealed bid
+	// application through its auction
+	if args[1] == REVIEW_CLEARED {
+		sealedBidding, err := t.ReopenSealedBidAuction(stub, applicationDetails)
+		if err != nil {
+			return nil, err
+		}
+		if sealedBidding {
+			applicationDetails.Status = STATE_SEALED_BIDDING
+		} else {
+			evaluationParams, err := t.BuildEvaluationParams(stub, applicationDetails)
+			if err != nil {
+				return nil, err
+			}
+			applicationDetails.Quotations = t.GetQuotesFromLenders(stub, applicationDetails, evaluationParams)
+			applicationDetails.Status = STATE_QUOTATIONS_RECEIVED
+		}
+	} else {
+		applicationDetails.Status = STATE_DECLINED
+	}
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetFraudRuleSettingsDetails(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	settings, err := t.GetFraudRuleSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(settings)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetFraudRuleSettings(stub shim.ChaincodeStubInterface) (FraudRuleSettings, error) {
+
+	// Fall back to the default rules when they have not been configured
+	settings := FraudRuleSettings{DuplicateWindowHours: 24, DealerWindowHours: 24, MaxDealerApplications: 20, IncomeLookbackDays: 180, IncomeTolerancePercent: 25}
+	bytes, err := stub.GetState(FRAUD_RULE_SETTINGS)
+	if err != nil {
+		return settings, err
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &settings)
+	}
+	return settings, err
+}
+
+// Every new application is screened and checked against the fraud rules, an exact screening match declines it
+// outright and any other hit holds it for manual review
+func (t *SmartLendingChaincode) HoldFlaggedApplication(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, evaluationParams EvaluationParams) (LoanApplication, bool, error) {
+
+	flags, err := t.EvaluateFraudRules(stub, applicationDetails, evaluationParams.MonthlyIncome)
+	if err != nil {
+		return applicationDetails, false, err
+	}
+	screening, err := t.ScreenName(stub, SCREENING_SUBJECT_BORROWER, applicationDetails.BorrowerId, applicationDetails.ApplicationNumber, evaluationParams.BorrowerName)
+	if err != nil {
+		return applicationDetails, false, err
+	}
+	if screening.Outcome != SCREENING_CLEAR {
+		flags = append(flags, t.GetScreeningFlag(screening))
+	}
+	if len(flags) == 0 {
+		return applicationDetails, false, nil
+	}
+
+	applicationDetails.FraudFlags = flags
+	applicationDetails.Status = STATE_MANUAL_REVIEW
+	if screening.Outcome == SCREENING_MATCH {
+		applicationDetails.Status = STATE_DECLINED
+	}
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	bytes, err := json.Marshal(applicationDetails)
+	if err != nil {
+		return applicationDetails, true, err
+	}
+	err = stub.SetEvent(APPLICATION_FLAGGED_EVENT, bytes)
+	return applicationDetails, true, err
+}
+
+func (t *SmartLendingChaincode) IsWithinWindow(date time.Time, currentTime time.Time, hours int) bool {
+	return !date.IsZero() && currentTime.Sub(date) <= time.Duration(hours)*time.Hour
+}
+
+func (t *SmartLendingChaincode) EvaluateFraudRules(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, monthlyIncome float64) ([]FraudFlag, error) {
+
+	var flags []FraudFlag
+	settings, err := t.GetFraudRuleSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	currentTime := t.GetTransactionTime(stub)
+	borrower, err := t.GetBorrowerDetails(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same SSN applying again within the window
+	for i := 0; i < len(borrower.Applications) && settings.DuplicateWindowHours > 0; i++ {
+		if borrower.Applications[i] == applicationDetails.ApplicationNumber {
+			continue
+		}
+		otherApplication, err := t.GetApplication(stub, borrower.Applications[i])
+		if err == nil && t.IsWithinWindow(otherApplication.AppliedDate, currentTime, settings.DuplicateWindowHours) {
+			flags = append(flags, FraudFlag{RuleId: FRAUD_DUPLICATE_SSN, Description: "SSN used on application " + otherApplication.ApplicationNumber + " within " + strconv.Itoa(settings.DuplicateWindowHours) + " hours"})
+			break
+		}
+	}
+
+	// The same vehicle financed or being financed elsewhere
+	if applicationDetails.VIN != "" {
+		vehicle, err := t.GetVehicleDetails(stub, applicationDetails.VIN)
+		if err == nil && t.HasActiveLien(vehicle) {
+			flags = append(flags, FraudFlag{RuleId: FRAUD_VIN_FINANCED, Description: "Vehicle already has an active lien"})
+		} else {
+			applicationIndex, err := t.GetApplicationIndex(stub)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < len(applicationIndex); i++ {
+				if applicationIndex[i] == applicationDetails.ApplicationNumber {
+					continue
+				}
+				otherApplication, err := t.GetApplication(stub, applicationIndex[i])
+				if err != nil || otherApplication.VIN != applicationDetails.VIN || !t.IsOpenApplication(otherApplication) {
+					continue
+				}
+				flags = append(flags, FraudFlag{RuleId: FRAUD_VIN_FINANCED, Description: "Vehicle is on open application " + otherApplication.ApplicationNumber})
+				break
+			}
+		}
+	}
+
+	// Abnormal volume from the dealer
+	if applicationDetails.DealerId != "" && settings.DealerWindowHours > 0 && settings.MaxDealerApplications > 0 {
+		dealer, err := t.GetDealerDetails(stub, applicationDetails.DealerId)
+		if err != nil {
+			return nil, err
+		}
+		var recentApplications int = 0
+		for i := 0; i < len(dealer.Applications); i++ {
+			otherApplication, err := t.GetApplication(stub, dealer.Applications[i])
+			if err == nil && t.IsWithinWindow(otherApplication.AppliedDate, currentTime, settings.DealerWindowHours) {
+				recentApplications++
+			}
+		}
+		if recentApplications > settings.MaxDealerApplications {
+			flags = append(flags, FraudFlag{RuleId: FRAUD_DEALER_VELOCITY, Description: strconv.Itoa(recentApplications) + " applications from the dealer within " + strconv.Itoa(settings.DealerWindowHours) + " hours"})
+		}
+	}
+
+	// Income stated differently on recent applications
+	for i := 0; i < len(borrower.StatedIncomes) && settings.IncomeLookbackDays > 0; i++ {
+		statedIncome := borrower.StatedIncomes[i]
+		if statedIncome.ApplicationNumber == applicationDetails.ApplicationNumber || statedIncome.MonthlyIncome <= 0 {
+			continue
+		}
+		if !t.IsWithinWindow(statedIncome.StatedDate, currentTime, settings.IncomeLookbackDays*24) {
+			continue
+		}
+		difference := math.Abs(monthlyIncome-statedIncome.MonthlyIncome) * 100 / statedIncome.MonthlyIncome
+		if difference > settings.IncomeTolerancePercent {
+			flags = append(flags, FraudFlag{RuleId: FRAUD_INCOME_MISMATCH, Description: "Income differs from application " + statedIncome.ApplicationNumber + " by " + strconv.FormatFloat(t.RoundAmount(difference), 'f', -1, 64) + "%"})
+			break
+		}
+	}
+
+	return flags, nil
+}
+
+func (t *SmartLendingChaincode) IsOpenApplication(applicationDetails LoanApplication) bool {
+	status := applicationDetails.Status
+	return status == STATE_APPLIED || status == STATE_QUOTATIONS_RECEIVED || status == STATE_SEALED_BIDDING || status == STATE_MANUAL_REVIEW ||
+		status == STATE_BID_ACCEPTED || status == STATE_PARTIALLY_DISBURSED || status == STATE_PERFORMING || status == STATE_NON_PERFORMING
+}
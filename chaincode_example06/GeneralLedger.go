@@ -0,0 +1,783 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 General ledger - Keys
+//==============================================================================================================================
+const CHART_OF_ACCOUNTS_PREFIX = "COA_"
+const JOURNAL_PREFIX = "JOURNAL_"
+const JOURNAL_SEQUENCE_PREFIX = "_journalsequence_"
+
+//==============================================================================================================================
+//	 General ledger - Account types
+//==============================================================================================================================
+const ACCOUNT_ASSET = "ASSET"
+const ACCOUNT_LIABILITY = "LIABILITY"
+const ACCOUNT_EQUITY = "EQUITY"
+const ACCOUNT_INCOME = "INCOME"
+const ACCOUNT_EXPENSE = "EXPENSE"
+
+//==============================================================================================================================
+//	 General ledger - Standard accounts every lender starts with
+//==============================================================================================================================
+const GL_CASH = "1000"
+const GL_LOANS_RECEIVABLE = "1100"
+const GL_INTEREST_RECEIVABLE = "1150"
+const GL_LOAN_LOSS_ALLOWANCE = "1190"
+const GL_INTEREST_INCOME = "4000"
+const GL_FEE_INCOME = "4100"
+const GL_RECOVERY_INCOME = "4200"
+const GL_GAIN_ON_SALE = "4300"
+const GL_WRITE_OFF_EXPENSE = "5000"
+const GL_PROVISION_EXPENSE = "5100"
+
+//==============================================================================================================================
+//	 General ledger - Journal entry types
+//==============================================================================================================================
+const ENTRY_DISBURSEMENT = "DISBURSEMENT"
+const ENTRY_INTEREST_ACCRUAL = "INTEREST_ACCRUAL"
+const ENTRY_PAYMENT_RECEIPT = "PAYMENT_RECEIPT"
+const ENTRY_PAYMENT_REVERSAL = "PAYMENT_REVERSAL"
+const ENTRY_FEE = "FEE"
+const ENTRY_WRITE_OFF = "WRITE_OFF"
+const ENTRY_RECOVERY = "RECOVERY"
+const ENTRY_LOAN_SALE = "LOAN_SALE"
+const ENTRY_LOAN_PURCHASE = "LOAN_PURCHASE"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type ChartOfAccounts struct {
+	LenderId int
+	Accounts []GLAccount
+}
+
+type GLAccount struct {
+	Code        string
+	Name        string
+	Type        string
+	DebitTotal  float64
+	CreditTotal float64
+}
+
+type JournalEntry struct {
+	EntryNumber       int
+	LenderId          int
+	EntryType         string
+	ApplicationNumber string
+	Description       string
+	EntryDate         time.Time
+	TransactionId     string
+	Lines             []JournalLine
+}
+
+type JournalLine struct {
+	AccountCode string
+	Debit       float64
+	Credit      float64
+}
+
+type TrialBalance struct {
+	LenderId          int
+	Accounts          []TrialBalanceLine
+	TotalDebits       float64
+	TotalCredits      float64
+	LoansReceivable   float64
+	LoanBookPrincipal float64
+	Difference        float64
+
+	InterestReceivable      float64
+	LoanBookAccruedInterest float64
+	InterestDifference      float64
+}
+
+type TrialBalanceLine struct {
+	Code   string
+	Name   string
+	Type   string
+	Debit  float64
+	Credit float64
+}
+
+type AccountStatement struct {
+	LenderId       int
+	AccountCode    string
+	AccountName    string
+	Lines          []StatementLine
+	ClosingBalance float64
+}
+
+type StatementLine struct {
+	EntryNumber       int
+	EntryDate         time.Time
+	EntryType         string
+	ApplicationNumber string
+	Description       string
+	Debit             float64
+	Credit            float64
+	Balance           float64
+}
+
+type LoanFee struct {
+	FeeNumber     int
+	Description   string
+	Amount        float64
+	ChargedDate   time.Time
+	TransactionId string
+}
+
+type LoanRecovery struct {
+	Amount        float64
+	Reference     string
+	RecoveryDate  time.Time
+	TransactionId string
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the lender id, account code, name and type
+func (t *SmartLendingChaincode) AddGLAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, account code, name and type")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	if args[1] == "" || args[2] == "" {
+		return nil, errors.New("Account code and name are required")
+	}
+	if args[3] != ACCOUNT_ASSET && args[3] != ACCOUNT_LIABILITY && args[3] != ACCOUNT_EQUITY && args[3] != ACCOUNT_INCOME && args[3] != ACCOUNT_EXPENSE {
+		return nil, errors.New("Invalid account type")
+	}
+
+	chart, err := t.GetChartOfAccounts(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(chart.Accounts); i++ {
+		if chart.Accounts[i].Code == args[1] {
+			return nil, errors.New("Account already exists")
+		}
+	}
+	chart.Accounts = append(chart.Accounts, GLAccount{Code: args[1], Name: args[2], Type: args[3]})
+
+	err = t.SaveChartOfAccounts(stub, chart)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(chart)
+}
+
+// Arguments are the application number, a description and the amount of the fee collected by the servicing lender
+func (t *SmartLendingChaincode) ChargeLoanFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, description and amount")
+	}
+
+	applicationDetails, servicingLenderId, err := t.GetServicedLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status == STATE_CLOSED {
+		return nil, errors.New("Loan is already closed")
+	}
+	amount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Invalid amount")
+	}
+
+	var fee LoanFee
+	fee.FeeNumber = len(applicationDetails.Fees) + 1
+	fee.Description = args[1]
+	fee.Amount = amount
+	fee.ChargedDate = t.GetTransactionTime(stub)
+	fee.TransactionId = stub.GetTxID()
+	applicationDetails.Fees = append(applicationDetails.Fees, fee)
+
+	lines := []JournalLine{t.Debit(GL_CASH, amount), t.Credit(GL_FEE_INCOME, amount)}
+	err = t.PostJournalEntry(stub, servicingLenderId, ENTRY_FEE, applicationDetails.ApplicationNumber, args[1], lines)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(fee)
+}
+
+func (t *SmartLendingChaincode) WriteOffLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, _, err := t.GetServicedLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_NON_PERFORMING {
+		return nil, errors.New("Only non performing loans can be written off")
+	}
+
+	// Each lender writes off the principal it still holds
+	currentTime := t.GetTransactionTime(stub)
+	holdings := t.GetHoldingsAsOf(applicationDetails, currentTime)
+	var writtenOffAmount float64 = 0
+	for i := 0; i < len(holdings); i++ {
+		outstandingPrincipal := t.GetLenderOutstandingPrincipal(applicationDetails, holdings[i].LenderId)
+		lines := []JournalLine{t.Debit(GL_WRITE_OFF_EXPENSE, outstandingPrincipal), t.Credit(GL_LOANS_RECEIVABLE, outstandingPrincipal)}
+		err = t.PostJournalEntry(stub, holdings[i].LenderId, ENTRY_WRITE_OFF, applicationDetails.ApplicationNumber, "Write-off of outstanding principal", lines)
+		if err != nil {
+			return nil, err
+		}
+		writtenOffAmount = writtenOffAmount + outstandingPrincipal
+	}
+
+	applicationDetails.Status = STATE_WRITTEN_OFF
+	applicationDetails.WrittenOffAmount = writtenOffAmount
+	applicationDetails.WriteOffDate = currentTime
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+// Arguments are the application number, the amount recovered and the payment reference
+func (t *SmartLendingChaincode) RecordLoanRecovery(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, amount and reference")
+	}
+
+	applicationDetails, _, err := t.GetServicedLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_WRITTEN_OFF {
+		return nil, errors.New("Recoveries can only be recorded against written off loans")
+	}
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Invalid amount")
+	}
+	if args[2] == "" {
+		return nil, errors.New("Payment reference is required")
+	}
+
+	// Recoveries are shared by the lenders who held the loan when it was written off
+	currentTime := t.GetTransactionTime(stub)
+	holdings := t.GetHoldingsAsOf(applicationDetails, applicationDetails.WriteOffDate)
+	shares := t.SplitByHoldings(holdings, amount)
+	for i := 0; i < len(holdings); i++ {
+		lines := []JournalLine{t.Debit(GL_CASH, shares[i]), t.Credit(GL_RECOVERY_INCOME, shares[i])}
+		err = t.PostJournalEntry(stub, holdings[i].LenderId, ENTRY_RECOVERY, applicationDetails.ApplicationNumber, "Recovery "+args[2], lines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recovery := LoanRecovery{Amount: amount, Reference: args[2], RecoveryDate: currentTime, TransactionId: stub.GetTxID()}
+	applicationDetails.Recoveries = append(applicationDetails.Recoveries, recovery)
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(recovery)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLenderChartOfAccounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	lenderId, err := t.GetLedgerLenderId(stub, args)
+	if err != nil {
+		return nil, err
+	}
+	chart, err := t.GetChartOfAccounts(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(chart)
+}
+
+func (t *SmartLendingChaincode) GetTrialBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	lenderId, err := t.GetLedgerLenderId(stub, args)
+	if err != nil {
+		return nil, err
+	}
+	chart, err := t.GetChartOfAccounts(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	trialBalance := TrialBalance{LenderId: lenderId}
+	for i := 0; i < len(chart.Accounts); i++ {
+		account := chart.Accounts[i]
+		line := TrialBalanceLine{Code: account.Code, Name: account.Name, Type: account.Type}
+		balance := t.RoundAmount(account.DebitTotal - account.CreditTotal)
+		if balance >= 0 {
+			line.Debit = balance
+		} else {
+			line.Credit = -balance
+		}
+		trialBalance.Accounts = append(trialBalance.Accounts, line)
+		trialBalance.TotalDebits = trialBalance.TotalDebits + line.Debit
+		trialBalance.TotalCredits = trialBalance.TotalCredits + line.Credit
+		if account.Code == GL_LOANS_RECEIVABLE {
+			trialBalance.LoansReceivable = balance
+		} else if account.Code == GL_INTEREST_RECEIVABLE {
+			trialBalance.InterestReceivable = balance
+		}
+	}
+
+	// Reconcile the receivable accounts against the lender's share of the loan book
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil || applicationDetails.Status == STATE_WRITTEN_OFF || applicationDetails.Status == STATE_CLOSED {
+			continue
+		}
+		if _, found := t.GetWinningBid(applicationDetails); !found {
+			continue
+		}
+		trialBalance.LoanBookPrincipal = trialBalance.LoanBookPrincipal + t.GetLenderOutstandingPrincipal(applicationDetails, lenderId)
+		trialBalance.LoanBookAccruedInterest = trialBalance.LoanBookAccruedInterest + t.GetLenderAccruedInterest(applicationDetails, lenderId)
+	}
+	trialBalance.TotalDebits = t.RoundAmount(trialBalance.TotalDebits)
+	trialBalance.TotalCredits = t.RoundAmount(trialBalance.TotalCredits)
+	trialBalance.LoanBookPrincipal = t.RoundAmount(trialBalance.LoanBookPrincipal)
+	trialBalance.Difference = t.RoundAmount(trialBalance.LoansReceivable - trialBalance.LoanBookPrincipal)
+	trialBalance.LoanBookAccruedInterest = t.RoundAmount(trialBalance.LoanBookAccruedInterest)
+	trialBalance.InterestDifference = t.RoundAmount(trialBalance.InterestReceivable - trialBalance.LoanBookAccruedInterest)
+
+	return json.Marshal(trialBalance)
+}
+
+// Arguments are the lender id, the account code and optionally an application number to filter the entries
+func (t *SmartLendingChaincode) GetAccountStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, account code and optionally the application number")
+	}
+	lenderId, err := t.GetLedgerLenderId(stub, args[:1])
+	if err != nil {
+		return nil, err
+	}
+	chart, err := t.GetChartOfAccounts(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := AccountStatement{LenderId: lenderId, AccountCode: args[1]}
+	var accountType string = ""
+	for i := 0; i < len(chart.Accounts); i++ {
+		if chart.Accounts[i].Code == args[1] {
+			statement.AccountName = chart.Accounts[i].Name
+			accountType = chart.Accounts[i].Type
+		}
+	}
+	if accountType == "" {
+		return nil, errors.New("Could not find account")
+	}
+
+	// Journal keys carry the entry number so the range query returns them in posting order
+	prefix := JOURNAL_PREFIX + strconv.Itoa(lenderId) + "_"
+	iterator, err := stub.RangeQueryState(prefix, prefix+"~")
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var balance float64 = 0
+	for iterator.HasNext() {
+		_, bytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry JournalEntry
+		err = json.Unmarshal(bytes, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 3 && entry.ApplicationNumber != args[2] {
+			continue
+		}
+		for j := 0; j < len(entry.Lines); j++ {
+			if entry.Lines[j].AccountCode != args[1] {
+				continue
+			}
+			// Balances are shown on the normal side of the account
+			if accountType == ACCOUNT_ASSET || accountType == ACCOUNT_EXPENSE {
+				balance = balance + entry.Lines[j].Debit - entry.Lines[j].Credit
+			} else {
+				balance = balance + entry.Lines[j].Credit - entry.Lines[j].Debit
+			}
+			line := StatementLine{EntryNumber: entry.EntryNumber, EntryDate: entry.EntryDate, EntryType: entry.EntryType, ApplicationNumber: entry.ApplicationNumber, Description: entry.Description, Debit: entry.Lines[j].Debit, Credit: entry.Lines[j].Credit, Balance: t.RoundAmount(balance)}
+			statement.Lines = append(statement.Lines, line)
+		}
+	}
+	statement.ClosingBalance = t.RoundAmount(balance)
+
+	return json.Marshal(statement)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetDefaultChartOfAccounts(lenderId int) ChartOfAccounts {
+
+	var chart ChartOfAccounts
+	chart.LenderId = lenderId
+	chart.Accounts = []GLAccount{
+		{Code: GL_CASH, Name: "Cash", Type: ACCOUNT_ASSET},
+		{Code: GL_LOANS_RECEIVABLE, Name: "Loans receivable", Type: ACCOUNT_ASSET},
+		{Code: GL_INTEREST_RECEIVABLE, Name: "Interest receivable", Type: ACCOUNT_ASSET},
+		{Code: GL_LOAN_LOSS_ALLOWANCE, Name: "Allowance for expected credit losses", Type: ACCOUNT_ASSET},
+		{Code: GL_INTEREST_INCOME, Name: "Interest income", Type: ACCOUNT_INCOME},
+		{Code: GL_FEE_INCOME, Name: "Fee income", Type: ACCOUNT_INCOME},
+		{Code: GL_RECOVERY_INCOME, Name: "Recoveries of written off loans", Type: ACCOUNT_INCOME},
+		{Code: GL_GAIN_ON_SALE, Name: "Gain or loss on sale of loans", Type: ACCOUNT_INCOME},
+		{Code: GL_WRITE_OFF_EXPENSE, Name: "Loan write-offs", Type: ACCOUNT_EXPENSE},
+		{Code: GL_PROVISION_EXPENSE, Name: "Expected credit loss provision", Type: ACCOUNT_EXPENSE},
+	}
+	return chart
+}
+
+func (t *SmartLendingChaincode) GetChartOfAccounts(stub shim.ChaincodeStubInterface, lenderId int) (ChartOfAccounts, error) {
+
+	// Lenders start with the standard chart of accounts
+	bytes, err := stub.GetState(CHART_OF_ACCOUNTS_PREFIX + strconv.Itoa(lenderId))
+	if err != nil {
+		return ChartOfAccounts{}, err
+	}
+	if bytes == nil {
+		return t.GetDefaultChartOfAccounts(lenderId), nil
+	}
+	var chart ChartOfAccounts
+	err = json.Unmarshal(bytes, &chart)
+	if err != nil {
+		return chart, err
+	}
+
+	// Standard accounts introduced after the chart was created are added on first use
+	defaultChart := t.GetDefaultChartOfAccounts(lenderId)
+	for i := 0; i < len(defaultChart.Accounts); i++ {
+		var accountFound bool = false
+		for j := 0; j < len(chart.Accounts); j++ {
+			if chart.Accounts[j].Code == defaultChart.Accounts[i].Code {
+				accountFound = true
+			}
+		}
+		if !accountFound {
+			chart.Accounts = append(chart.Accounts, defaultChart.Accounts[i])
+		}
+	}
+	return chart, nil
+}
+
+func (t *SmartLendingChaincode) SaveChartOfAccounts(stub shim.ChaincodeStubInterface, chart ChartOfAccounts) error {
+
+	bytes, err := json.Marshal(chart)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(CHART_OF_ACCOUNTS_PREFIX+strconv.Itoa(chart.LenderId), bytes)
+}
+
+func (t *SmartLendingChaincode) GetLedgerLenderId(stub shim.ChaincodeStubInterface, args []string) (int, error) {
+
+	if len(args) != 1 {
+		return 0, errors.New("Incorrect number of arguments. Expecting lender id")
+	}
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, errors.New("Invalid lender id")
+	}
+
+	// Lenders see their own books while admins can see every lender's
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return 0, err
+	}
+	if caller.Role != ADMIN {
+		err = t.CheckLenderAccess(caller, lenderId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return lenderId, nil
+}
+
+func (t *SmartLendingChaincode) GetServicedLoan(stub shim.ChaincodeStubInterface, applicationNumber string) (LoanApplication, int, error) {
+
+	applicationDetails, err := t.GetApplication(stub, applicationNumber)
+	if err != nil {
+		return applicationDetails, 0, err
+	}
+	if _, found := t.GetWinningBid(applicationDetails); !found {
+		return applicationDetails, 0, errors.New("Loan has not been booked")
+	}
+
+	// Only the servicing lender acts on the loan
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return applicationDetails, 0, err
+	}
+	servicingLenderId := t.GetServicingLenderId(applicationDetails, t.GetTransactionTime(stub))
+	err = t.CheckLenderAccess(caller, servicingLenderId)
+	if err != nil {
+		return applicationDetails, 0, err
+	}
+	return applicationDetails, servicingLenderId, nil
+}
+
+func (t *SmartLendingChaincode) Debit(accountCode string, amount float64) JournalLine {
+	return JournalLine{AccountCode: accountCode, Debit: t.RoundAmount(amount)}
+}
+
+func (t *SmartLendingChaincode) Credit(accountCode string, amount float64) JournalLine {
+	return JournalLine{AccountCode: accountCode, Credit: t.RoundAmount(amount)}
+}
+
+func (t *SmartLendingChaincode) RoundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func (t *SmartLendingChaincode) PostJournalEntry(stub shim.ChaincodeStubInterface, lenderId int, entryType string, applicationNumber string, description string, lines []JournalLine) error {
+
+	// Amounts are posted in whole cents and credits may be negative to absorb rounding
+	var postedLines []JournalLine
+	var totalDebits float64 = 0
+	var totalCredits float64 = 0
+	for i := 0; i < len(lines); i++ {
+		if lines[i].Debit == 0 && lines[i].Credit == 0 {
+			continue
+		}
+		if lines[i].Debit < 0 || lines[i].Credit < 0 {
+			lines[i] = JournalLine{AccountCode: lines[i].AccountCode, Debit: -lines[i].Credit, Credit: -lines[i].Debit}
+		}
+		postedLines = append(postedLines, lines[i])
+		totalDebits = totalDebits + lines[i].Debit
+		totalCredits = totalCredits + lines[i].Credit
+	}
+	if len(postedLines) == 0 {
+		return nil
+	}
+	if math.Abs(totalDebits-totalCredits) >= 0.005 {
+		return errors.New("Journal entry is not balanced")
+	}
+
+	chart, err := t.GetChartOfAccounts(stub, lenderId)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(postedLines); i++ {
+		var accountFound bool = false
+		for j := 0; j < len(chart.Accounts); j++ {
+			if chart.Accounts[j].Code == postedLines[i].AccountCode {
+				chart.Accounts[j].DebitTotal = t.RoundAmount(chart.Accounts[j].DebitTotal + postedLines[i].Debit)
+				chart.Accounts[j].CreditTotal = t.RoundAmount(chart.Accounts[j].CreditTotal + postedLines[i].Credit)
+				accountFound = true
+			}
+		}
+		if !accountFound {
+			return errors.New("Could not find account " + postedLines[i].AccountCode)
+		}
+	}
+	err = t.SaveChartOfAccounts(stub, chart)
+	if err != nil {
+		return err
+	}
+
+	entryNumber, err := t.GetNextSequence(stub, JOURNAL_SEQUENCE_PREFIX+strconv.Itoa(lenderId))
+	if err != nil {
+		return err
+	}
+	entry := JournalEntry{EntryNumber: entryNumber, LenderId: lenderId, EntryType: entryType, ApplicationNumber: applicationNumber, Description: description, EntryDate: t.GetTransactionTime(stub), TransactionId: stub.GetTxID(), Lines: postedLines}
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(fmt.Sprintf("%s%d_%08d", JOURNAL_PREFIX, lenderId, entryNumber), bytes)
+}
+
+func (t *SmartLendingChaincode) SplitByHoldings(holdings []SyndicateParticipant, amount float64) []float64 {
+
+	// The rounding difference goes to the lead lender
+	var shares []float64
+	var allocated float64 = 0
+	var leadIndex int = 0
+	for i := 0; i < len(holdings); i++ {
+		share := math.Floor(amount*holdings[i].SharePercent) / 100
+		if holdings[i].IsLead {
+			leadIndex = i
+		}
+		allocated = allocated + share
+		shares = append(shares, share)
+	}
+	if len(shares) > 0 {
+		shares[leadIndex] = t.RoundAmount(shares[leadIndex] + amount - allocated)
+	}
+	return shares
+}
+
+func (t *SmartLendingChaincode) PostDisbursement(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, disbursement Disbursement) error {
+
+	holdings := t.GetHoldingsAsOf(applicationDetails, t.GetTransactionTime(stub))
+	shares := t.SplitByHoldings(holdings, disbursement.Amount)
+	for i := 0; i < len(holdings); i++ {
+		lines := []JournalLine{t.Debit(GL_LOANS_RECEIVABLE, shares[i]), t.Credit(GL_CASH, shares[i])}
+		err := t.PostJournalEntry(stub, holdings[i].LenderId, ENTRY_DISBURSEMENT, applicationDetails.ApplicationNumber, "Disbursement "+disbursement.Reference, lines)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) PostRepaymentReceipt(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, installment PaymentDetail) (PaymentDetail, error) {
+
+	description := "Installment " + strconv.Itoa(installment.InstallmentNumber)
+	var accruals []InterestAccrual
+	var accruedInterest float64 = 0
+	for i := 0; i < len(installment.Allocations); i++ {
+		allocation := installment.Allocations[i]
+
+		// Recognise whatever interest of the installment has not been accrued yet before settling it
+		unaccruedInterest := allocation.InterestAmount - t.GetLenderAccrual(installment, allocation.LenderId)
+		lines := []JournalLine{t.Debit(GL_INTEREST_RECEIVABLE, unaccruedInterest), t.Credit(GL_INTEREST_INCOME, unaccruedInterest)}
+		err := t.PostJournalEntry(stub, allocation.LenderId, ENTRY_INTEREST_ACCRUAL, applicationDetails.ApplicationNumber, description, lines)
+		if err != nil {
+			return installment, err
+		}
+
+		lines = []JournalLine{t.Debit(GL_CASH, allocation.TotalAmount), t.Credit(GL_LOANS_RECEIVABLE, allocation.PrincipalAmount), t.Credit(GL_INTEREST_RECEIVABLE, allocation.InterestAmount)}
+		err = t.PostJournalEntry(stub, allocation.LenderId, ENTRY_PAYMENT_RECEIPT, applicationDetails.ApplicationNumber, description, lines)
+		if err != nil {
+			return installment, err
+		}
+		accruals = append(accruals, InterestAccrual{LenderId: allocation.LenderId, Amount: allocation.InterestAmount})
+		accruedInterest = accruedInterest + allocation.InterestAmount
+	}
+
+	// The installment is now fully accrued to the lenders who received it
+	installment.Accruals = accruals
+	installment.AccruedInterest = t.RoundAmount(accruedInterest)
+	return installment, nil
+}
+
+func (t *SmartLendingChaincode) PostRepaymentReversal(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, installment PaymentDetail) error {
+
+	// The interest stays accrued and receivable while the payment itself is reversed
+	description := "Reversal of installment " + strconv.Itoa(installment.InstallmentNumber)
+	for i := 0; i < len(installment.Allocations); i++ {
+		allocation := installment.Allocations[i]
+		lines := []JournalLine{t.Debit(GL_LOANS_RECEIVABLE, allocation.PrincipalAmount), t.Debit(GL_INTEREST_RECEIVABLE, allocation.InterestAmount), t.Credit(GL_CASH, allocation.TotalAmount)}
+		err := t.PostJournalEntry(stub, allocation.LenderId, ENTRY_PAYMENT_REVERSAL, applicationDetails.ApplicationNumber, description, lines)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) PostLoanTransfer(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, offer LoanTransferOffer) (LoanApplication, error) {
+
+	// The buyer takes over the principal and accrued interest of the installments falling due from the effective date
+	var transferredPrincipal float64 = 0
+	var transferredInterest float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		installment := applicationDetails.RepaymentSchedule[i]
+		if installment.RepaymentStatus == STATE_RECOVERED || installment.DueDate.Before(offer.EffectiveDate) {
+			continue
+		}
+		transferredPrincipal = transferredPrincipal + installment.PrincipalAmount*offer.SharePercent/100
+
+		// The ownership record is already in place so the seller's holding before the sale is added back
+		sellerAccrual := t.GetLenderAccrual(installment, offer.SellerLenderId)
+		if sellerAccrual <= 0 {
+			continue
+		}
+		var sellerShare float64 = offer.SharePercent
+		holdings := t.GetHoldingsAsOf(applicationDetails, installment.DueDate)
+		for j := 0; j < len(holdings); j++ {
+			if holdings[j].LenderId == offer.SellerLenderId {
+				sellerShare = sellerShare + holdings[j].SharePercent
+			}
+		}
+		accrual := t.RoundAmount(sellerAccrual * offer.SharePercent / sellerShare)
+		installment = t.AddLenderAccrual(installment, offer.SellerLenderId, -accrual)
+		installment = t.AddLenderAccrual(installment, offer.BuyerLenderId, accrual)
+		applicationDetails.RepaymentSchedule[i] = installment
+		transferredInterest = transferredInterest + accrual
+	}
+	transferredPrincipal = t.RoundAmount(transferredPrincipal)
+	gain := offer.Price - transferredPrincipal - transferredInterest
+	description := "Transfer offer " + strconv.Itoa(offer.OfferNumber)
+
+	lines := []JournalLine{t.Debit(GL_CASH, offer.Price), t.Credit(GL_LOANS_RECEIVABLE, transferredPrincipal), t.Credit(GL_INTEREST_RECEIVABLE, transferredInterest), t.Credit(GL_GAIN_ON_SALE, gain)}
+	err := t.PostJournalEntry(stub, offer.SellerLenderId, ENTRY_LOAN_SALE, applicationDetails.ApplicationNumber, description, lines)
+	if err != nil {
+		return applicationDetails, err
+	}
+	lines = []JournalLine{t.Debit(GL_LOANS_RECEIVABLE, transferredPrincipal), t.Debit(GL_INTEREST_RECEIVABLE, transferredInterest), t.Credit(GL_CASH, offer.Price), t.Debit(GL_GAIN_ON_SALE, gain)}
+	err = t.PostJournalEntry(stub, offer.BuyerLenderId, ENTRY_LOAN_PURCHASE, applicationDetails.ApplicationNumber, description, lines)
+	return applicationDetails, err
+}
+
+func (t *SmartLendingChaincode) GetLenderOutstandingPrincipal(applicationDetails LoanApplication, lenderId int) float64 {
+
+	// Until the schedule is generated the lender holds its share of what has been paid out
+	if len(applicationDetails.RepaymentSchedule) == 0 {
+		participant, found := t.GetSyndicateShare(applicationDetails, lenderId)
+		if !found {
+			return 0
+		}
+		return applicationDetails.DisbursedAmount * participant.SharePercent / 100
+	}
+
+	// Each installment belongs to the lenders holding the loan on its due date
+	var outstandingPrincipal float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		installment := applicationDetails.RepaymentSchedule[i]
+		if installment.RepaymentStatus == STATE_RECOVERED {
+			continue
+		}
+		holdings := t.GetHoldingsAsOf(applicationDetails, installment.DueDate)
+		for j := 0; j < len(holdings); j++ {
+			if holdings[j].LenderId == lenderId {
+				outstandingPrincipal = outstandingPrincipal + installment.PrincipalAmount*holdings[j].SharePercent/100
+			}
+		}
+	}
+	return outstandingPrincipal
+}
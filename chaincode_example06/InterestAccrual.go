@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Interest accrual - Journal entry types
+//==============================================================================================================================
+const ENTRY_INTEREST_REVERSAL = "INTEREST_REVERSAL"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type InterestAccrual struct {
+	LenderId int
+	Amount   float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number and optionally the business date to accrue to, which defaults to today
+func (t *SmartLendingChaincode) AccrueInterest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number and optionally the business date")
+	}
+
+	applicationDetails, _, err := t.GetServicedLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_PERFORMING && applicationDetails.Status != STATE_NON_PERFORMING {
+		return nil, errors.New("Interest can only be accrued on an active loan")
+	}
+	if applicationDetails.IsNonAccrual {
+		return nil, errors.New("Loan is on non-accrual")
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	businessDate := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
+	if len(args) == 2 {
+		businessDate, err = time.Parse(DISBURSEMENT_DATE_FORMAT, args[1])
+		if err != nil {
+			return nil, errors.New("Invalid business date. Expecting " + DISBURSEMENT_DATE_FORMAT)
+		}
+		if businessDate.After(currentTime) {
+			return nil, errors.New("Business date cannot be in the future")
+		}
+	}
+	if businessDate.Before(applicationDetails.AccruedToDate) {
+		return nil, errors.New("Interest has already been accrued to " + applicationDetails.AccruedToDate.Format(DISBURSEMENT_DATE_FORMAT))
+	}
+
+	applicationDetails, err = t.AccrueLoanInterest(stub, applicationDetails, businessDate)
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetInterestAccruedAsOf(applicationDetails LoanApplication, installmentIndex int, businessDate time.Time) float64 {
+
+	// Interest on an installment builds up day by day from the previous due date
+	installment := applicationDetails.RepaymentSchedule[installmentIndex]
+	periodStart := applicationDetails.DisbursementDate
+	if installmentIndex > 0 {
+		periodStart = applicationDetails.RepaymentSchedule[installmentIndex-1].DueDate
+	}
+	if !businessDate.After(periodStart) {
+		return 0
+	}
+	if !businessDate.Before(installment.DueDate) {
+		return installment.InterestAmount
+	}
+	daysElapsed := int(businessDate.Sub(periodStart).Hours() / 24)
+	daysInPeriod := int(installment.DueDate.Sub(periodStart).Hours() / 24)
+	return t.RoundAmount(installment.InterestAmount * float64(daysElapsed) / float64(daysInPeriod))
+}
+
+func (t *SmartLendingChaincode) AccrueLoanInterest(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, businessDate time.Time) (LoanApplication, error) {
+
+	// Gather the accrual of each lender so every lender gets a single entry per run
+	var lenderIds []int
+	lenderAccruals := map[int]float64{}
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		installment := applicationDetails.RepaymentSchedule[i]
+		if installment.RepaymentStatus == STATE_RECOVERED {
+			continue
+		}
+		accrual := t.RoundAmount(t.GetInterestAccruedAsOf(applicationDetails, i, businessDate) - installment.AccruedInterest)
+		if accrual <= 0 {
+			continue
+		}
+
+		// The interest belongs to the lenders who will hold the installment when it falls due
+		holdings := t.GetHoldingsAsOf(applicationDetails, installment.DueDate)
+		shares := t.SplitByHoldings(holdings, accrual)
+		for j := 0; j < len(holdings); j++ {
+			installment = t.AddLenderAccrual(installment, holdings[j].LenderId, shares[j])
+			if _, found := lenderAccruals[holdings[j].LenderId]; !found {
+				lenderIds = append(lenderIds, holdings[j].LenderId)
+			}
+			lenderAccruals[holdings[j].LenderId] = lenderAccruals[holdings[j].LenderId] + shares[j]
+		}
+		installment.AccruedInterest = t.RoundAmount(installment.AccruedInterest + accrual)
+		applicationDetails.RepaymentSchedule[i] = installment
+	}
+
+	description := "Interest accrued to " + businessDate.Format(DISBURSEMENT_DATE_FORMAT)
+	for i := 0; i < len(lenderIds); i++ {
+		amount := lenderAccruals[lenderIds[i]]
+		lines := []JournalLine{t.Debit(GL_INTEREST_RECEIVABLE, amount), t.Credit(GL_INTEREST_INCOME, amount)}
+		err := t.PostJournalEntry(stub, lenderIds[i], ENTRY_INTEREST_ACCRUAL, applicationDetails.ApplicationNumber, description, lines)
+		if err != nil {
+			return applicationDetails, err
+		}
+	}
+
+	applicationDetails.AccruedToDate = businessDate
+	applicationDetails.AccruedInterest = t.GetAccruedInterestNotDue(applicationDetails)
+	return applicationDetails, nil
+}
+
+func (t *SmartLendingChaincode) UpdateAccrualStatus(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (LoanApplication, error) {
+
+	// Income is no longer recognised on a non performing loan and whatever has not been received is taken back out
+	applicationDetails.IsNonAccrual = applicationDetails.Status == STATE_NON_PERFORMING
+	if applicationDetails.IsNonAccrual {
+		var lenderIds []int
+		lenderAccruals := map[int]float64{}
+		for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+			installment := applicationDetails.RepaymentSchedule[i]
+			if installment.RepaymentStatus == STATE_RECOVERED {
+				continue
+			}
+			for j := 0; j < len(installment.Accruals); j++ {
+				if _, found := lenderAccruals[installment.Accruals[j].LenderId]; !found {
+					lenderIds = append(lenderIds, installment.Accruals[j].LenderId)
+				}
+				lenderAccruals[installment.Accruals[j].LenderId] = lenderAccruals[installment.Accruals[j].LenderId] + installment.Accruals[j].Amount
+			}
+			applicationDetails.RepaymentSchedule[i].Accruals = nil
+			applicationDetails.RepaymentSchedule[i].AccruedInterest = 0
+		}
+
+		for i := 0; i < len(lenderIds); i++ {
+			amount := lenderAccruals[lenderIds[i]]
+			lines := []JournalLine{t.Debit(GL_INTEREST_INCOME, amount), t.Credit(GL_INTEREST_RECEIVABLE, amount)}
+			err := t.PostJournalEntry(stub, lenderIds[i], ENTRY_INTEREST_REVERSAL, applicationDetails.ApplicationNumber, "Reversal of unrealised interest on non-accrual", lines)
+			if err != nil {
+				return applicationDetails, err
+			}
+		}
+	}
+
+	applicationDetails.AccruedInterest = t.GetAccruedInterestNotDue(applicationDetails)
+	return applicationDetails, nil
+}
+
+func (t *SmartLendingChaincode) GetAccruedInterestNotDue(applicationDetails LoanApplication) float64 {
+
+	var accruedInterest float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		installment := applicationDetails.RepaymentSchedule[i]
+		if installment.RepaymentStatus != STATE_RECOVERED && installment.DueDate.After(applicationDetails.AccruedToDate) {
+			accruedInterest = accruedInterest + installment.AccruedInterest
+		}
+	}
+	return t.RoundAmount(accruedInterest)
+}
+
+func (t *SmartLendingChaincode) GetLenderAccrual(installment PaymentDetail, lenderId int) float64 {
+
+	for i := 0; i < len(installment.Accruals); i++ {
+		if installment.Accruals[i].LenderId == lenderId {
+			return installment.Accruals[i].Amount
+		}
+	}
+	return 0
+}
+
+func (t *SmartLendingChaincode) AddLenderAccrual(installment PaymentDetail, lenderId int, amount float64) PaymentDetail {
+
+	for i := 0; i < len(installment.Accruals); i++ {
+		if installment.Accruals[i].LenderId == lenderId {
+			installment.Accruals[i].Amount = t.RoundAmount(installment.Accruals[i].Amount + amount)
+			return installment
+		}
+	}
+	installment.Accruals = append(installment.Accruals, InterestAccrual{LenderId: lenderId, Amount: t.RoundAmount(amount)})
+	return installment
+}
+
+func (t *SmartLendingChaincode) GetLenderAccruedInterest(applicationDetails LoanApplication, lenderId int) float64 {
+
+	var accruedInterest float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus != STATE_RECOVERED {
+			accruedInterest = accruedInterest + t.GetLenderAccrual(applicationDetails.RepaymentSchedule[i], lenderId)
+		}
+	}
+	return accruedInterest
+}
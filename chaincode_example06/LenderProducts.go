@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Lender products - Keys and defaults
+//==============================================================================================================================
+const LENDER_PRODUCT_PREFIX = "PRODUCT_"
+const DEFAULT_BID_VALIDITY_DAYS = 7
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type LenderProduct struct {
+	LenderId        int
+	ProductName     string
+	BidValidityDays int
+	// Maximum loan to value ratio in percent, zero when the lender does not cap the LTV
+	MaxLTV               float64
+	AllowReducedSanction bool
+	// Probability of default and loss given default per credit stage, the defaults apply when empty
+	ProvisionRates []ProvisionRate
+	// Maximum debt to income ratio in percent, zero when the lender does not test affordability
+	MaxDTI float64
+	// Manual underwriting refers the applications meeting either criterion to the lender's queue, zero disables a criterion
+	ManualUnderwriting  bool
+	ReferralAmount      float64
+	ReferralCreditScore int
+	// Document types which must be verified before a bid of the lender can be confirmed
+	RequiredDocuments []string
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the lender id, product name, bid validity in days and optionally the maximum LTV, whether
+// a reduced amount can be sanctioned when the request exceeds a limit and the maximum debt to income ratio.
+// Neither limit is applied by default, a maximum LTV or DTI of 0 leaves it off
+func (t *SmartLendingChaincode) SetLenderProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 && len(args) != 5 && len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, product name, bid validity in days and optionally the maximum LTV, reduced sanction flag and maximum DTI")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	bidValidityDays, err := strconv.Atoi(args[2])
+	if err != nil || bidValidityDays <= 0 {
+		return nil, errors.New("Invalid bid validity")
+	}
+
+	product := t.GetLenderProduct(stub, lenderId)
+	product.ProductName = args[1]
+	product.BidValidityDays = bidValidityDays
+	if len(args) >= 5 {
+		maxLTV, err := strconv.ParseFloat(args[3], 64)
+		if err != nil || maxLTV < 0 {
+			return nil, errors.New("Invalid maximum LTV")
+		}
+		allowReducedSanction, err := strconv.ParseBool(args[4])
+		if err != nil {
+			return nil, errors.New("Invalid reduced sanction flag")
+		}
+		product.MaxLTV = maxLTV
+		product.AllowReducedSanction = allowReducedSanction
+	}
+	if len(args) == 6 {
+		maxDTI, err := strconv.ParseFloat(args[5], 64)
+		if err != nil || maxDTI < 0 {
+			return nil, errors.New("Invalid maximum DTI")
+		}
+		product.MaxDTI = maxDTI
+	}
+
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(LENDER_PRODUCT_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLenderProductDetails(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+
+	return json.Marshal(t.GetLenderProduct(stub, lenderId))
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLenderProduct(stub shim.ChaincodeStubInterface, lenderId int) LenderProduct {
+
+	// Fall back to the default product when the lender has not configured one, the LTV and DTI are only capped once the lender sets a limit
+	product := LenderProduct{LenderId: lenderId, ProductName: "Vehicle loan", BidValidityDays: DEFAULT_BID_VALIDITY_DAYS}
+
+	bytes, err := stub.GetState(LENDER_PRODUCT_PREFIX + strconv.Itoa(lenderId))
+	if err == nil && bytes != nil {
+		err = json.Unmarshal(bytes, &product)
+	}
+
+	return product
+}
+
+func (t *SmartLendingChaincode) GetBidValidUntil(stub shim.ChaincodeStubInterface, lenderId int) time.Time {
+	product := t.GetLenderProduct(stub, lenderId)
+	return t.GetTransactionTime(stub).AddDate(0, 0, product.BidValidityDays)
+}
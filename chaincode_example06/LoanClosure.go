@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Loan closure - Keys and event names
+//==============================================================================================================================
+const NO_DUES_CERTIFICATE_PREFIX = "NODUES_"
+
+// Fabric keeps a single event per transaction, so the guarantee invocation and the closure of a loan are
+// reported together
+const LOAN_STATUS_EVENT = "LoanStatusChanged"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type NoDuesCertificate struct {
+	CertificateNumber    string
+	ApplicationNumber    string
+	AccountNumber        int
+	LoanAmount           float64
+	TotalRepaid          float64
+	LoanStateHash        string
+	ClosingTransactionId string
+	ClosingTimestamp     string
+	IssueDate            time.Time
+	ClosedLoan           ClosedLoanState
+}
+
+// The part of the closed loan the certificate attests to, later bookkeeping on the loan does not affect it
+type ClosedLoanState struct {
+	ApplicationNumber    string
+	BorrowerId           string
+	LenderId             int
+	RepaymentSchedule    []PaymentDetail
+	ClosureDate          time.Time
+	ClosingTransactionId string
+}
+
+type LoanStatusNotification struct {
+	ApplicationNumber string
+	Status            int
+	GuaranteesInvoked bool
+	Guarantee         GuaranteeNotification
+	LoanClosed        bool
+	NoDuesCertificate NoDuesCertificate
+}
+
+type CertificateVerification struct {
+	CertificateNumber string
+	ApplicationNumber string
+	LoanStateHash     string
+	IsValid           bool
+	Reason            string
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetNoDuesCertificate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationViewAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := stub.GetState(NO_DUES_CERTIFICATE_PREFIX + args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, errors.New("No dues certificate not issued for application " + args[0])
+	}
+	return bytes, nil
+}
+
+func (t *SmartLendingChaincode) VerifyNoDuesCertificate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number and optionally the certificate hash")
+	}
+
+	// Get the issued certificate
+	bytes, err := stub.GetState(NO_DUES_CERTIFICATE_PREFIX + args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, errors.New("No dues certificate not issued for application " + args[0])
+	}
+	var certificate NoDuesCertificate
+	err = json.Unmarshal(bytes, &certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	verification := CertificateVerification{CertificateNumber: certificate.CertificateNumber, ApplicationNumber: certificate.ApplicationNumber, LoanStateHash: certificate.LoanStateHash, IsValid: true}
+
+	// Recompute the hash from the certificate and from the loan held on the ledger and compare them
+	applicationDetails, err := t.GetApplication(stub, certificate.ApplicationNumber)
+	if err != nil {
+		return nil, err
+	}
+	loanState := t.GetClosedLoanState(applicationDetails, certificate.ClosedLoan.ClosureDate, certificate.ClosedLoan.ClosingTransactionId)
+
+	if applicationDetails.Status != STATE_CLOSED {
+		verification.IsValid = false
+		verification.Reason = "Loan is not closed"
+	} else if t.HashLoanState(certificate.ClosedLoan) != certificate.LoanStateHash {
+		verification.IsValid = false
+		verification.Reason = "Certificate does not match its hash"
+	} else if t.HashLoanState(loanState) != certificate.LoanStateHash {
+		verification.IsValid = false
+		verification.Reason = "Loan state does not match the certificate"
+	} else if len(args) > 1 && args[1] != certificate.LoanStateHash {
+		verification.IsValid = false
+		verification.Reason = "Presented hash does not match the certificate"
+	}
+
+	return json.Marshal(verification)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) IsLoanFullyRepaid(applicationDetails LoanApplication) bool {
+
+	if len(applicationDetails.RepaymentSchedule) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus != STATE_RECOVERED {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *SmartLendingChaincode) CloseLoan(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (LoanApplication, NoDuesCertificate, error) {
+
+	var certificate NoDuesCertificate
+
+	// Release the lender's lien on the vehicle
+	err := t.ReleaseLien(stub, applicationDetails)
+	if err != nil {
+		return applicationDetails, certificate, err
+	}
+
+	// Save the final state of the loan
+	applicationDetails.Status = STATE_CLOSED
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+	loanState := t.GetClosedLoanState(applicationDetails, t.GetTransactionTime(stub), stub.GetTxID())
+
+	// Issue the no dues certificate against the final loan state
+	var totalRepaid float64 = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		totalRepaid = totalRepaid + applicationDetails.RepaymentSchedule[i].TotalEMI
+	}
+
+	certificate.CertificateNumber = "NDC-" + applicationDetails.ApplicationNumber
+	certificate.ApplicationNumber = applicationDetails.ApplicationNumber
+	certificate.AccountNumber = applicationDetails.AccountNumber
+	certificate.LoanAmount = applicationDetails.LoanAmount
+	certificate.TotalRepaid = totalRepaid
+	certificate.LoanStateHash = t.HashLoanState(loanState)
+	certificate.ClosedLoan = loanState
+	certificate.ClosingTransactionId = stub.GetTxID()
+	txnTimeStamp, err := stub.GetTxTimestamp()
+	if err == nil {
+		certificate.ClosingTimestamp = txnTimeStamp.String()
+	}
+	certificate.IssueDate = t.GetTransactionTime(stub)
+
+	bytes, err := json.Marshal(certificate)
+	if err != nil {
+		return applicationDetails, certificate, err
+	}
+	err = stub.PutState(NO_DUES_CERTIFICATE_PREFIX+applicationDetails.ApplicationNumber, bytes)
+
+	return applicationDetails, certificate, err
+}
+
+// Lets the borrower, dealer, guarantors and registry know about the change in the loan's status
+func (t *SmartLendingChaincode) RaiseLoanStatusEvent(stub shim.ChaincodeStubInterface, notification LoanStatusNotification) error {
+
+	if !notification.GuaranteesInvoked && !notification.LoanClosed {
+		return nil
+	}
+	bytes, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(LOAN_STATUS_EVENT, bytes)
+}
+
+// The certificate is issued in the name of the lender servicing the loan when it closed, which is the buyer
+// for a transferred loan
+func (t *SmartLendingChaincode) GetClosedLoanState(applicationDetails LoanApplication, closureDate time.Time, closingTransactionId string) ClosedLoanState {
+	return ClosedLoanState{ApplicationNumber: applicationDetails.ApplicationNumber, BorrowerId: applicationDetails.BorrowerId, LenderId: t.GetServicingLenderId(applicationDetails, closureDate), RepaymentSchedule: applicationDetails.RepaymentSchedule, ClosureDate: closureDate, ClosingTransactionId: closingTransactionId}
+}
+
+func (t *SmartLendingChaincode) HashLoanState(loanState ClosedLoanState) string {
+	bytes, _ := json.Marshal(loanState)
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Status types - Loan transfer offer
+//==============================================================================================================================
+const TRANSFER_OFFERED = "OFFERED"
+const TRANSFER_ACCEPTED = "ACCEPTED"
+const TRANSFER_CANCELLED = "CANCELLED"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type LoanTransferOffer struct {
+	OfferNumber    int
+	SellerLenderId int
+	BuyerLenderId  int
+	SharePercent   float64
+	Price          float64
+	EffectiveDate  time.Time
+	Status         string
+	OfferDate      time.Time
+	ResponseDate   time.Time
+}
+
+// A seller of zero records the lenders who originated the loan
+type OwnershipRecord struct {
+	SellerLenderId    int
+	BuyerLenderId     int
+	SharePercent      float64
+	Price             float64
+	EffectiveDate     time.Time
+	TransferServicing bool
+	OfferNumber       int
+	TransactionId     string
+	RecordedDate      time.Time
+}
+
+type LoanOwnership struct {
+	ApplicationNumber string
+	ServicingLenderId int
+	Holdings          []SyndicateParticipant
+	OwnershipHistory  []OwnershipRecord
+	TransferOffers    []LoanTransferOffer
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number, seller and buyer lender ids, the share of the loan in percent, the price and
+// the date as YYYY-MM-DD from which the buyer receives the cash flows
+func (t *SmartLendingChaincode) OfferLoanTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, seller lender id, buyer lender id, share percent, price and effective date")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	sellerLenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid seller lender id")
+	}
+	buyerLenderId, err := strconv.Atoi(args[2])
+	if err != nil || buyerLenderId <= 0 || buyerLenderId == sellerLenderId {
+		return nil, errors.New("Invalid buyer lender id")
+	}
+	sharePercent, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || sharePercent <= 0 || sharePercent > 100 {
+		return nil, errors.New("Invalid share percent")
+	}
+	price, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || price < 0 {
+		return nil, errors.New("Invalid price")
+	}
+	effectiveDate, err := time.Parse(DISBURSEMENT_DATE_FORMAT, args[5])
+	if err != nil {
+		return nil, errors.New("Invalid effective date")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, sellerLenderId)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckTransferableLoan(stub, applicationDetails, sellerLenderId, sharePercent, effectiveDate)
+	if err != nil {
+		return nil, err
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	var offer LoanTransferOffer
+	offer.OfferNumber = len(applicationDetails.TransferOffers) + 1
+	offer.SellerLenderId = sellerLenderId
+	offer.BuyerLenderId = buyerLenderId
+	offer.SharePercent = sharePercent
+	offer.Price = price
+	offer.EffectiveDate = effectiveDate
+	offer.Status = TRANSFER_OFFERED
+	offer.OfferDate = currentTime
+	applicationDetails.TransferOffers = append(applicationDetails.TransferOffers, offer)
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(offer)
+}
+
+func (t *SmartLendingChaincode) AcceptLoanTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.RespondToLoanTransfer(stub, args, TRANSFER_ACCEPTED)
+}
+
+func (t *SmartLendingChaincode) CancelLoanTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.RespondToLoanTransfer(stub, args, TRANSFER_CANCELLED)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLoanOwnership(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := t.GetWinningBid(applicationDetails); !found {
+		return nil, errors.New("Loan has not been booked")
+	}
+
+	var ownership LoanOwnership
+	ownership.ApplicationNumber = applicationDetails.ApplicationNumber
+	ownership.ServicingLenderId = t.GetServicingLenderId(applicationDetails, t.GetTransactionTime(stub))
+	ownership.Holdings = t.GetSyndicateParticipants(applicationDetails)
+	ownership.OwnershipHistory = applicationDetails.OwnershipHistory
+	ownership.TransferOffers = applicationDetails.TransferOffers
+
+	return json.Marshal(ownership)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+// Arguments are the application number and offer number, the buyer accepts the offer and the seller cancels it
+func (t *SmartLendingChaincode) RespondToLoanTransfer(stub shim.ChaincodeStubInterface, args []string, response string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number and offer number")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	offerNumber, err := strconv.Atoi(args[1])
+	if err != nil || offerNumber <= 0 || offerNumber > len(applicationDetails.TransferOffers) {
+		return nil, errors.New("Invalid offer number")
+	}
+	offer := applicationDetails.TransferOffers[offerNumber-1]
+	if offer.Status != TRANSFER_OFFERED {
+		return nil, errors.New("Offer is no longer open")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	currentTime := t.GetTransactionTime(stub)
+
+	if response == TRANSFER_CANCELLED {
+		err = t.CheckLenderAccess(caller, offer.SellerLenderId)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = t.CheckLenderAccess(caller, offer.BuyerLenderId)
+		if err != nil {
+			return nil, err
+		}
+		// The seller must still hold the share when the buyer accepts
+		err = t.CheckTransferableLoan(stub, applicationDetails, offer.SellerLenderId, offer.SharePercent, offer.EffectiveDate)
+		if err != nil {
+			return nil, err
+		}
+		// The buyer must stay within its own exposure limits after the purchase
+		buyerExposure := t.GetLenderLoanExposure(applicationDetails, offer.BuyerLenderId) + t.GetOutstandingPrincipal(applicationDetails)*offer.SharePercent/100
+		err = t.CheckExposureLimits(stub, applicationDetails, offer.BuyerLenderId, buyerExposure)
+		if err != nil {
+			return nil, err
+		}
+		applicationDetails, err = t.TransferLoanShare(stub, applicationDetails, offer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offer.Status = response
+	offer.ResponseDate = currentTime
+	applicationDetails.TransferOffers[offerNumber-1] = offer
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(offer)
+}
+
+func (t *SmartLendingChaincode) CheckTransferableLoan(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, sellerLenderId int, sharePercent float64, effectiveDate time.Time) error {
+
+	// Only performing and non performing loans which have been fully disbursed can be sold
+	if applicationDetails.Status != STATE_PERFORMING && applicationDetails.Status != STATE_NON_PERFORMING {
+		return errors.New("Loan cannot be transferred in its current state")
+	}
+	// Pooled loans back the pool's tranches and stay with the sponsor
+	poolId := t.GetLoanPoolId(stub, applicationDetails.ApplicationNumber)
+	if poolId != "" {
+		pool, err := t.GetPoolDetails(stub, poolId)
+		if err == nil && pool.SponsorLenderId == sellerLenderId {
+			return errors.New("Loan is held in pool " + poolId)
+		}
+	}
+	holding, found := t.GetSyndicateShare(applicationDetails, sellerLenderId)
+	if !found || holding.SharePercent < sharePercent {
+		return errors.New("Seller does not hold enough of the loan")
+	}
+
+	// Cash flows cannot be transferred retrospectively
+	currentTime := t.GetTransactionTime(stub)
+	today := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
+	if effectiveDate.Before(today) {
+		return errors.New("Effective date cannot be in the past")
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) TransferLoanShare(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, offer LoanTransferOffer) (LoanApplication, error) {
+
+	participants := t.GetSyndicateParticipants(applicationDetails)
+	currentTime := t.GetTransactionTime(stub)
+
+	// Record the original holders as the start of the chain of ownership
+	if len(applicationDetails.OwnershipHistory) == 0 {
+		for i := 0; i < len(participants); i++ {
+			if participants[i].Status != PARTICIPANT_ACTIVE {
+				continue
+			}
+			origination := OwnershipRecord{BuyerLenderId: participants[i].LenderId, SharePercent: participants[i].SharePercent, EffectiveDate: applicationDetails.DisbursementDate, TransferServicing: participants[i].IsLead, RecordedDate: currentTime}
+			applicationDetails.OwnershipHistory = append(applicationDetails.OwnershipHistory, origination)
+		}
+	}
+
+	// Servicing moves to the buyer when the servicing lender sells its entire holding
+	var transferServicing bool = false
+	var buyerFound bool = false
+	for i := 0; i < len(participants); i++ {
+		if participants[i].LenderId == offer.SellerLenderId && participants[i].Status == PARTICIPANT_ACTIVE {
+			participants[i].SharePercent = participants[i].SharePercent - offer.SharePercent
+			if participants[i].IsLead && participants[i].SharePercent <= 0 {
+				participants[i].IsLead = false
+				transferServicing = true
+			}
+		}
+	}
+	for i := 0; i < len(participants); i++ {
+		if participants[i].LenderId != offer.BuyerLenderId {
+			continue
+		}
+		if participants[i].Status == PARTICIPANT_ACTIVE {
+			participants[i].SharePercent = participants[i].SharePercent + offer.SharePercent
+		} else {
+			participants[i].SharePercent = offer.SharePercent
+			participants[i].Status = PARTICIPANT_ACTIVE
+			participants[i].JoinedDate = currentTime
+		}
+		participants[i].IsLead = participants[i].IsLead || transferServicing
+		buyerFound = true
+	}
+	if !buyerFound {
+		buyer := SyndicateParticipant{LenderId: offer.BuyerLenderId, SharePercent: offer.SharePercent, Status: PARTICIPANT_ACTIVE, IsLead: transferServicing, JoinedDate: currentTime}
+		participants = append(participants, buyer)
+	}
+	applicationDetails.Participants = participants
+
+	var record OwnershipRecord
+	record.SellerLenderId = offer.SellerLenderId
+	record.BuyerLenderId = offer.BuyerLenderId
+	record.SharePercent = offer.SharePercent
+	record.Price = offer.Price
+	record.EffectiveDate = offer.EffectiveDate
+	record.TransferServicing = transferServicing
+	record.OfferNumber = offer.OfferNumber
+	record.TransactionId = stub.GetTxID()
+	record.RecordedDate = currentTime
+	applicationDetails.OwnershipHistory = append(applicationDetails.OwnershipHistory, record)
+
+	// Move the transferred principal and accrued interest between the lenders' books
+	applicationDetails, err := t.PostLoanTransfer(stub, applicationDetails, offer)
+	if err != nil {
+		return applicationDetails, err
+	}
+
+	// The lien on the vehicle follows the servicing lender
+	if transferServicing {
+		err = t.TransferLien(stub, applicationDetails, offer.BuyerLenderId)
+		if err != nil {
+			return applicationDetails, err
+		}
+	}
+
+	return applicationDetails, nil
+}
+
+func (t *SmartLendingChaincode) GetHoldingsAsOf(applicationDetails LoanApplication, asOf time.Time) []SyndicateParticipant {
+
+	// Undo the transfers which take effect after the given date, latest first
+	var holdings []SyndicateParticipant
+	holdings = append(holdings, t.GetSyndicateParticipants(applicationDetails)...)
+	for i := len(applicationDetails.OwnershipHistory) - 1; i >= 0; i-- {
+		record := applicationDetails.OwnershipHistory[i]
+		if record.SellerLenderId == 0 || !record.EffectiveDate.After(asOf) {
+			continue
+		}
+		for j := 0; j < len(holdings); j++ {
+			if holdings[j].LenderId == record.SellerLenderId {
+				holdings[j].SharePercent = holdings[j].SharePercent + record.SharePercent
+				holdings[j].Status = PARTICIPANT_ACTIVE
+				holdings[j].IsLead = holdings[j].IsLead || record.TransferServicing
+			}
+			if holdings[j].LenderId == record.BuyerLenderId {
+				holdings[j].SharePercent = holdings[j].SharePercent - record.SharePercent
+				holdings[j].IsLead = holdings[j].IsLead && !record.TransferServicing
+			}
+		}
+	}
+
+	var activeHoldings []SyndicateParticipant
+	for i := 0; i < len(holdings); i++ {
+		if holdings[i].Status == PARTICIPANT_ACTIVE && (holdings[i].SharePercent > 0 || holdings[i].IsLead) {
+			activeHoldings = append(activeHoldings, holdings[i])
+		}
+	}
+	return activeHoldings
+}
+
+func (t *SmartLendingChaincode) GetServicingLenderId(applicationDetails LoanApplication, asOf time.Time) int {
+	holdings := t.GetHoldingsAsOf(applicationDetails, asOf)
+	for i := 0; i < len(holdings); i++ {
+		if holdings[i].IsLead {
+			return holdings[i].LenderId
+		}
+	}
+	winningBid, _ := t.GetWinningBid(applicationDetails)
+	return winningBid.LenderId
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 PII protection - Keys
+//==============================================================================================================================
+const SSN_INDEX_PREFIX = "SSN_"
+
+// The raw SSN never reaches the chaincode. Clients submit the hex encoded HMAC-SHA256 of the SSN under a key
+// the lenders share off the ledger, the same key has to be used everywhere for repeat borrowers to be found
+const SSN_HASH_LENGTH = 64
+
+// The borrower's personal details, profile and stated incomes included, are encrypted by the client under a
+// data key held off the ledger by the lender's key service, the chaincode keeps only the ciphertext and the id
+// of the key. Destroying the key in the key service makes every copy of the details on the ledger unreadable
+
+//==============================================================================================================================
+//	 Status types - Borrower PII
+//==============================================================================================================================
+const PII_AVAILABLE = "AVAILABLE"
+const PII_ERASED = "ERASED"
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) FindApplicationsBySSN(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting SSN hash")
+	}
+
+	ssnHash, err := t.ParseSSNHash(args[0])
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := stub.GetState(SSN_INDEX_PREFIX + ssnHash)
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		return json.Marshal([]string{})
+	}
+	borrower, err := t.GetBorrowerDetails(stub, string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(borrower.Applications)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) ParseSSNHash(ssnHash string) (string, error) {
+
+	ssnHash = strings.ToLower(ssnHash)
+	_, err := hex.DecodeString(ssnHash)
+	if err != nil || len(ssnHash) != SSN_HASH_LENGTH {
+		return "", errors.New("SSN must be submitted as its hex encoded HMAC-SHA256 hash")
+	}
+	return ssnHash, nil
+}
+
+// The profile and stated incomes are kept in the clear only for the lenders' decisions, callers read them from
+// the encrypted details through the key service. Dealers do not see the borrower's personal details
+func (t *SmartLendingChaincode) MaskPII(stub shim.ChaincodeStubInterface, caller CallerDetails, borrower Borrower) Borrower {
+
+	borrower.SSNHash = ""
+	borrower.Profile = BorrowerProfile{}
+	borrower.StatedIncomes = nil
+	if caller.Role == DEALER {
+		borrower.DataKeyId = ""
+		borrower.EncryptedPII = ""
+	}
+	return borrower
+}
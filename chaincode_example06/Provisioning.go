@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Provisioning - Keys
+//==============================================================================================================================
+const PROVISIONING_PREFIX = "PROVISIONING_"
+
+//==============================================================================================================================
+//	 Provisioning - Credit stages
+//==============================================================================================================================
+const STAGE_PERFORMING = 1
+const STAGE_UNDERPERFORMING = 2
+const STAGE_CREDIT_IMPAIRED = 3
+
+//==============================================================================================================================
+//	 Provisioning - Staging rules
+//==============================================================================================================================
+// Days past due beyond which credit risk is considered to have increased significantly or the loan credit impaired
+const STAGE_2_DAYS_PAST_DUE = 30
+const STAGE_3_DAYS_PAST_DUE = 90
+
+// Missed installments over the life of the loan that signal a significant increase in credit risk even when cured
+const SICR_MISSED_INSTALLMENTS = 2
+
+//==============================================================================================================================
+//	 Provisioning - Journal entry types
+//==============================================================================================================================
+const ENTRY_PROVISION = "PROVISION"
+
+// Probability of default and loss given default in percent used when the lender has not configured its own
+var defaultProvisionRates = []ProvisionRate{
+	{Stage: STAGE_PERFORMING, ProbabilityOfDefault: 1, LossGivenDefault: 45},
+	{Stage: STAGE_UNDERPERFORMING, ProbabilityOfDefault: 20, LossGivenDefault: 45},
+	{Stage: STAGE_CREDIT_IMPAIRED, ProbabilityOfDefault: 100, LossGivenDefault: 60},
+}
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type ProvisionRate struct {
+	Stage                int
+	ProbabilityOfDefault float64
+	LossGivenDefault     float64
+}
+
+type ProvisioningRun struct {
+	LenderId       int
+	BusinessDate   time.Time
+	Loans          []LoanProvision
+	TotalExposure  float64
+	TotalProvision float64
+	RunDate        time.Time
+	TransactionId  string
+}
+
+type LoanProvision struct {
+	ApplicationNumber    string
+	Stage                int
+	DaysPastDue          int
+	StagingReasons       []string
+	Exposure             float64
+	ProbabilityOfDefault float64
+	LossGivenDefault     float64
+	Provision            float64
+}
+
+type ProvisioningReport struct {
+	LenderId       int
+	BusinessDate   time.Time
+	Stages         []StageSummary
+	TotalExposure  float64
+	TotalProvision float64
+	CoverageRatio  float64
+	Loans          []LoanProvision
+}
+
+type StageSummary struct {
+	Stage         int
+	Loans         int
+	Exposure      float64
+	Provision     float64
+	CoverageRatio float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the lender id, the stage and the probability of default and loss given default in percent
+func (t *SmartLendingChaincode) SetProvisionRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, stage, probability of default and loss given default")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	stage, err := strconv.Atoi(args[1])
+	if err != nil || stage < STAGE_PERFORMING || stage > STAGE_CREDIT_IMPAIRED {
+		return nil, errors.New("Invalid stage")
+	}
+	probabilityOfDefault, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || probabilityOfDefault < 0 || probabilityOfDefault > 100 {
+		return nil, errors.New("Invalid probability of default")
+	}
+	lossGivenDefault, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || lossGivenDefault < 0 || lossGivenDefault > 100 {
+		return nil, errors.New("Invalid loss given default")
+	}
+
+	product := t.GetLenderProduct(stub, lenderId)
+	product.ProvisionRates = t.GetProvisionRates(product)
+	for i := 0; i < len(product.ProvisionRates); i++ {
+		if product.ProvisionRates[i].Stage == stage {
+			product.ProvisionRates[i].ProbabilityOfDefault = probabilityOfDefault
+			product.ProvisionRates[i].LossGivenDefault = lossGivenDefault
+		}
+	}
+
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(LENDER_PRODUCT_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+// Arguments are the lender id and optionally the business date to stage the loans at, which defaults to today
+func (t *SmartLendingChaincode) RunProvisioning(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id and optionally the business date")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	businessDate := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
+	if len(args) == 2 {
+		businessDate, err = time.Parse(DISBURSEMENT_DATE_FORMAT, args[1])
+		if err != nil {
+			return nil, errors.New("Invalid business date. Expecting " + DISBURSEMENT_DATE_FORMAT)
+		}
+		if businessDate.After(currentTime) {
+			return nil, errors.New("Business date cannot be in the future")
+		}
+	}
+	previousRun, err := t.GetProvisioningRun(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	if businessDate.Before(previousRun.BusinessDate) {
+		return nil, errors.New("Provisioning has already been run for " + previousRun.BusinessDate.Format(DISBURSEMENT_DATE_FORMAT))
+	}
+
+	// Stage every loan the lender holds and measure the expected loss on its exposure
+	product := t.GetLenderProduct(stub, lenderId)
+	provisionRates := t.GetProvisionRates(product)
+	run := ProvisioningRun{LenderId: lenderId, BusinessDate: businessDate, RunDate: currentTime, TransactionId: stub.GetTxID()}
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil {
+			continue
+		}
+		if applicationDetails.Status != STATE_PERFORMING && applicationDetails.Status != STATE_NON_PERFORMING && applicationDetails.Status != STATE_PARTIALLY_DISBURSED {
+			continue
+		}
+		exposure := t.RoundAmount(t.GetLenderOutstandingPrincipal(applicationDetails, lenderId) + t.GetLenderAccruedInterest(applicationDetails, lenderId))
+		if exposure <= 0 {
+			continue
+		}
+
+		var loanProvision LoanProvision
+		loanProvision.ApplicationNumber = applicationDetails.ApplicationNumber
+		loanProvision.Stage, loanProvision.DaysPastDue, loanProvision.StagingReasons = t.GetCreditStage(stub, applicationDetails, businessDate)
+		loanProvision.Exposure = exposure
+		for j := 0; j < len(provisionRates); j++ {
+			if provisionRates[j].Stage == loanProvision.Stage {
+				loanProvision.ProbabilityOfDefault = provisionRates[j].ProbabilityOfDefault
+				loanProvision.LossGivenDefault = provisionRates[j].LossGivenDefault
+			}
+		}
+		loanProvision.Provision = t.RoundAmount(exposure * loanProvision.ProbabilityOfDefault * loanProvision.LossGivenDefault / 10000)
+
+		run.Loans = append(run.Loans, loanProvision)
+		run.TotalExposure = t.RoundAmount(run.TotalExposure + exposure)
+		run.TotalProvision = t.RoundAmount(run.TotalProvision + loanProvision.Provision)
+	}
+
+	// Only the movement in the allowance since the last run is charged or released
+	movement := run.TotalProvision - previousRun.TotalProvision
+	lines := []JournalLine{t.Debit(GL_PROVISION_EXPENSE, movement), t.Credit(GL_LOAN_LOSS_ALLOWANCE, movement)}
+	err = t.PostJournalEntry(stub, lenderId, ENTRY_PROVISION, "", "Expected credit loss as of "+businessDate.Format(DISBURSEMENT_DATE_FORMAT), lines)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(PROVISIONING_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetProvisioningReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	lenderId, err := t.GetLedgerLenderId(stub, args)
+	if err != nil {
+		return nil, err
+	}
+	run, err := t.GetProvisioningRun(stub, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	var report ProvisioningReport
+	report.LenderId = lenderId
+	report.BusinessDate = run.BusinessDate
+	report.TotalExposure = run.TotalExposure
+	report.TotalProvision = run.TotalProvision
+	report.Loans = run.Loans
+	for stage := STAGE_PERFORMING; stage <= STAGE_CREDIT_IMPAIRED; stage++ {
+		summary := StageSummary{Stage: stage}
+		for i := 0; i < len(run.Loans); i++ {
+			if run.Loans[i].Stage == stage {
+				summary.Loans++
+				summary.Exposure = t.RoundAmount(summary.Exposure + run.Loans[i].Exposure)
+				summary.Provision = t.RoundAmount(summary.Provision + run.Loans[i].Provision)
+			}
+		}
+		if summary.Exposure > 0 {
+			summary.CoverageRatio = t.RoundAmount(summary.Provision * 100 / summary.Exposure)
+		}
+		report.Stages = append(report.Stages, summary)
+	}
+	if report.TotalExposure > 0 {
+		report.CoverageRatio = t.RoundAmount(report.TotalProvision * 100 / report.TotalExposure)
+	}
+
+	return json.Marshal(report)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetProvisionRates(product LenderProduct) []ProvisionRate {
+
+	if len(product.ProvisionRates) == 0 {
+		var provisionRates []ProvisionRate
+		return append(provisionRates, defaultProvisionRates...)
+	}
+	return product.ProvisionRates
+}
+
+func (t *SmartLendingChaincode) GetProvisioningRun(stub shim.ChaincodeStubInterface, lenderId int) (ProvisioningRun, error) {
+
+	var run ProvisioningRun
+	bytes, err := stub.GetState(PROVISIONING_PREFIX + strconv.Itoa(lenderId))
+	if err != nil {
+		return run, err
+	}
+	if bytes == nil {
+		run.LenderId = lenderId
+		return run, nil
+	}
+	err = json.Unmarshal(bytes, &run)
+	return run, err
+}
+
+func (t *SmartLendingChaincode) GetDaysPastDue(applicationDetails LoanApplication, businessDate time.Time) int {
+
+	// Days past due run from the oldest installment still unpaid
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		installment := applicationDetails.RepaymentSchedule[i]
+		if installment.RepaymentStatus == STATE_RECOVERED {
+			continue
+		}
+		if installment.DueDate.Before(businessDate) {
+			return int(businessDate.Sub(installment.DueDate).Hours() / 24)
+		}
+		return 0
+	}
+	return 0
+}
+
+func (t *SmartLendingChaincode) GetCreditStage(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, businessDate time.Time) (int, int, []string) {
+
+	var reasons []string
+	daysPastDue := t.GetDaysPastDue(applicationDetails, businessDate)
+
+	// Credit impaired loans
+	if applicationDetails.Status == STATE_NON_PERFORMING {
+		reasons = append(reasons, "Loan is non performing")
+	}
+	if daysPastDue > STAGE_3_DAYS_PAST_DUE {
+		reasons = append(reasons, "More than "+strconv.Itoa(STAGE_3_DAYS_PAST_DUE)+" days past due")
+	}
+	if len(reasons) > 0 {
+		return STAGE_CREDIT_IMPAIRED, daysPastDue, reasons
+	}
+
+	// Significant increase in credit risk since origination
+	if daysPastDue > STAGE_2_DAYS_PAST_DUE {
+		reasons = append(reasons, "More than "+strconv.Itoa(STAGE_2_DAYS_PAST_DUE)+" days past due")
+	}
+	var missedInstallments int = 0
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus == STATE_MISSED {
+			missedInstallments++
+		}
+	}
+	if missedInstallments >= SICR_MISSED_INSTALLMENTS {
+		reasons = append(reasons, strconv.Itoa(missedInstallments)+" installments missed")
+	}
+	if t.HasOtherNonPerformingLoan(stub, applicationDetails) {
+		reasons = append(reasons, "Borrower has another non performing loan")
+	}
+	if len(reasons) > 0 {
+		return STAGE_UNDERPERFORMING, daysPastDue, reasons
+	}
+
+	return STAGE_PERFORMING, daysPastDue, reasons
+}
+
+func (t *SmartLendingChaincode) HasOtherNonPerformingLoan(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) bool {
+
+	borrower, err := t.GetBorrowerDetails(stub, applicationDetails.BorrowerId)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < len(borrower.Applications); i++ {
+		if borrower.Applications[i] == applicationDetails.ApplicationNumber {
+			continue
+		}
+		otherApplication, err := t.GetApplication(stub, borrower.Applications[i])
+		if err == nil && (otherApplication.Status == STATE_NON_PERFORMING || otherApplication.Status == STATE_WRITTEN_OFF) {
+			return true
+		}
+	}
+	return false
+}
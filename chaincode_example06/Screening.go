@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Screening - Keys
+//==============================================================================================================================
+const SCREENING_ENTRY_PREFIX = "SCREENINGENTRY_"
+const SCREENING_ENTRY_INDEX = "_screeningentryindex"
+const SCREENING_ENTRY_SEQUENCE = "_screeningentrysequence"
+const SCREENING_RESULT_PREFIX = "SCREENINGRESULT_"
+const SCREENING_RESULT_SEQUENCE = "_screeningresultsequence"
+
+//==============================================================================================================================
+//	 Screening - Subjects, statuses and outcomes
+//==============================================================================================================================
+const SCREENING_SUBJECT_BORROWER = "BORROWER"
+const SCREENING_SUBJECT_DEALER = "DEALER"
+const SCREENING_SUBJECT_ANY = "ANY"
+
+const SCREENING_ENTRY_ACTIVE = "ACTIVE"
+const SCREENING_ENTRY_REMOVED = "REMOVED"
+
+const SCREENING_CLEAR = "CLEAR"
+const SCREENING_POTENTIAL_MATCH = "POTENTIAL_MATCH"
+const SCREENING_MATCH = "MATCH"
+
+const MATCH_EXACT = "EXACT"
+const MATCH_FUZZY = "FUZZY"
+
+// Minimum similarity in percent for two names to be reported as a potential match
+const FUZZY_MATCH_THRESHOLD = 85.0
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type ScreeningEntry struct {
+	EntryId        string
+	Name           string
+	NormalizedName string
+	SubjectType    string
+	ListName       string
+	Reason         string
+	Status         string
+	AddedBy        string
+	AddedDate      time.Time
+	RemovedBy      string
+	RemovedDate    time.Time
+	RemovalReason  string
+}
+
+type ScreeningResult struct {
+	ResultNumber      int
+	SubjectType       string
+	SubjectId         string
+	ApplicationNumber string
+	Outcome           string
+	Matches           []ScreeningMatch
+	ScreenedDate      time.Time
+	TransactionId     string
+}
+
+type ScreeningMatch struct {
+	EntryId   string
+	ListName  string
+	Name      string
+	MatchType string
+	Score     float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the name, the type of subject it applies to, the list it comes from and the reason for listing
+func (t *SmartLendingChaincode) AddScreeningEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name, subject type, list name and reason")
+	}
+	normalizedName := t.NormalizeName(args[0])
+	if normalizedName == "" {
+		return nil, errors.New("Name is required")
+	}
+	if args[1] != SCREENING_SUBJECT_BORROWER && args[1] != SCREENING_SUBJECT_DEALER && args[1] != SCREENING_SUBJECT_ANY {
+		return nil, errors.New("Invalid subject type")
+	}
+	if args[2] == "" {
+		return nil, errors.New("List name is required")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	sequence, err := t.GetNextSequence(stub, SCREENING_ENTRY_SEQUENCE)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := ScreeningEntry{EntryId: fmt.Sprintf("SCR%06d", sequence), Name: args[0], NormalizedName: normalizedName, SubjectType: args[1], ListName: args[2], Reason: args[3], Status: SCREENING_ENTRY_ACTIVE, AddedBy: caller.Username, AddedDate: t.GetTransactionTime(stub)}
+	err = t.SaveScreeningEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var entryIndex []string
+	bytes, err := stub.GetState(SCREENING_ENTRY_INDEX)
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &entryIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	entryIndex = append(entryIndex, entry.EntryId)
+	bytes, err = json.Marshal(entryIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(SCREENING_ENTRY_INDEX, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(entry)
+}
+
+// Arguments are the entry id and the reason for removal
+func (t *SmartLendingChaincode) RemoveScreeningEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting entry id and reason")
+	}
+
+	entry, err := t.GetScreeningEntry(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if entry.Status != SCREENING_ENTRY_ACTIVE {
+		return nil, errors.New("Entry has already been removed")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Removed entries are kept so past screening results can still be explained
+	entry.Status = SCREENING_ENTRY_REMOVED
+	entry.RemovedBy = caller.Username
+	entry.RemovedDate = t.GetTransactionTime(stub)
+	entry.RemovalReason = args[1]
+	err = t.SaveScreeningEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(entry)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetScreeningList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	entries, err := t.GetScreeningEntries(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(entries)
+}
+
+// Arguments are optionally the subject id to filter the results
+func (t *SmartLendingChaincode) GetScreeningResults(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting optionally the subject id")
+	}
+
+	iterator, err := stub.RangeQueryState(SCREENING_RESULT_PREFIX, SCREENING_RESULT_PREFIX+"~")
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var results []ScreeningResult
+	for iterator.HasNext() {
+		_, bytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var result ScreeningResult
+		err = json.Unmarshal(bytes, &result)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 && result.SubjectId != args[0] && result.ApplicationNumber != args[0] {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	return json.Marshal(results)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetScreeningEntry(stub shim.ChaincodeStubInterface, entryId string) (ScreeningEntry, error) {
+
+	var entry ScreeningEntry
+	bytes, err := stub.GetState(SCREENING_ENTRY_PREFIX + entryId)
+	if err != nil {
+		return entry, err
+	}
+	if bytes == nil {
+		return entry, errors.New("Could not find screening entry")
+	}
+	err = json.Unmarshal(bytes, &entry)
+	return entry, err
+}
+
+func (t *SmartLendingChaincode) SaveScreeningEntry(stub shim.ChaincodeStubInterface, entry ScreeningEntry) error {
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(SCREENING_ENTRY_PREFIX+entry.EntryId, bytes)
+}
+
+func (t *SmartLendingChaincode) GetScreeningEntries(stub shim.ChaincodeStubInterface) ([]ScreeningEntry, error) {
+
+	var entryIndex []string
+	bytes, err := stub.GetState(SCREENING_ENTRY_INDEX)
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &entryIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []ScreeningEntry
+	for i := 0; i < len(entryIndex); i++ {
+		entry, err := t.GetScreeningEntry(stub, entryIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (t *SmartLendingChaincode) NormalizeName(name string) string {
+
+	// Upper case letters and digits separated by single spaces
+	var normalized []rune
+	for _, r := range strings.ToUpper(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			normalized = append(normalized, r)
+		} else {
+			normalized = append(normalized, ' ')
+		}
+	}
+	return strings.Join(strings.Fields(string(normalized)), " ")
+}
+
+func (t *SmartLendingChaincode) SortNameTokens(name string) string {
+	tokens := strings.Fields(name)
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+func (t *SmartLendingChaincode) LevenshteinDistance(a string, b string) int {
+
+	source := []rune(a)
+	target := []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := 0; j <= len(target); j++ {
+		previous[j] = j
+	}
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
+
+func (t *SmartLendingChaincode) GetNameSimilarity(a string, b string) float64 {
+
+	maxLength := len([]rune(a))
+	if len([]rune(b)) > maxLength {
+		maxLength = len([]rune(b))
+	}
+	if maxLength == 0 {
+		return 0
+	}
+	return t.RoundAmount(float64(maxLength-t.LevenshteinDistance(a, b)) * 100 / float64(maxLength))
+}
+
+func (t *SmartLendingChaincode) ScreenName(stub shim.ChaincodeStubInterface, subjectType string, subjectId string, applicationNumber string, name string) (ScreeningResult, error) {
+
+	result := ScreeningResult{SubjectType: subjectType, SubjectId: subjectId, ApplicationNumber: applicationNumber, Outcome: SCREENING_CLEAR, ScreenedDate: t.GetTransactionTime(stub), TransactionId: stub.GetTxID()}
+	entries, err := t.GetScreeningEntries(stub)
+	if err != nil {
+		return result, err
+	}
+
+	// Names are compared as given and with their words sorted so the order of first and last names does not matter
+	normalizedName := t.NormalizeName(name)
+	for i := 0; i < len(entries) && normalizedName != ""; i++ {
+		entry := entries[i]
+		if entry.Status != SCREENING_ENTRY_ACTIVE || (entry.SubjectType != SCREENING_SUBJECT_ANY && entry.SubjectType != subjectType) {
+			continue
+		}
+		match := ScreeningMatch{EntryId: entry.EntryId, ListName: entry.ListName, Name: entry.Name}
+		if entry.NormalizedName == normalizedName || t.SortNameTokens(entry.NormalizedName) == t.SortNameTokens(normalizedName) {
+			match.MatchType = MATCH_EXACT
+			match.Score = 100
+			result.Outcome = SCREENING_MATCH
+		} else {
+			match.Score = t.GetNameSimilarity(entry.NormalizedName, normalizedName)
+			sortedScore := t.GetNameSimilarity(t.SortNameTokens(entry.NormalizedName), t.SortNameTokens(normalizedName))
+			if sortedScore > match.Score {
+				match.Score = sortedScore
+			}
+			if match.Score < FUZZY_MATCH_THRESHOLD {
+				continue
+			}
+			match.MatchType = MATCH_FUZZY
+			if result.Outcome == SCREENING_CLEAR {
+				result.Outcome = SCREENING_POTENTIAL_MATCH
+			}
+		}
+		result.Matches = append(result.Matches, match)
+	}
+
+	// Every screening is recorded for audit whatever the outcome, the screened name itself is not kept
+	result.ResultNumber, err = t.GetNextSequence(stub, SCREENING_RESULT_SEQUENCE)
+	if err != nil {
+		return result, err
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	err = stub.PutState(fmt.Sprintf("%s%08d", SCREENING_RESULT_PREFIX, result.ResultNumber), bytes)
+	return result, err
+}
+
+func (t *SmartLendingChaincode) GetScreeningFlag(result ScreeningResult) FraudFlag {
+
+	var matchedEntries []string
+	for i := 0; i < len(result.Matches); i++ {
+		matchedEntries = append(matchedEntries, result.Matches[i].EntryId+" "+result.Matches[i].MatchType+" "+strconv.FormatFloat(result.Matches[i].Score, 'f', -1, 64)+"%")
+	}
+	return FraudFlag{RuleId: FRAUD_SCREENING_MATCH, Description: "Screening " + strings.ToLower(strings.Replace(result.Outcome, "_", " ", -1)) + " on " + strings.Join(matchedEntries, ", ")}
+}
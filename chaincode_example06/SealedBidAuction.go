@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Sealed bid auction - Keys
+//==============================================================================================================================
+const SEALED_BID_AUCTION_PREFIX = "SEALEDBID_"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type SealedBidAuction struct {
+	ApplicationNumber string
+	BiddingDeadline   time.Time
+	RevealDeadline    time.Time
+	Commitments       []SealedBidCommitment
+	IsRanked          bool
+}
+
+type SealedBidCommitment struct {
+	LenderId      int
+	Commitment    string
+	CommitDate    time.Time
+	IsRevealed    bool
+	RevealDate    time.Time
+	RevealedOffer BiddingDetails
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the bidding and reveal windows in hours followed by the CreateLoanApplication arguments
+func (t *SmartLendingChaincode) CreateSealedBidApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting bidding window, reveal window and application details")
+	}
+
+	biddingWindow, err := strconv.Atoi(args[0])
+	if err != nil || biddingWindow <= 0 {
+		return nil, errors.New("Invalid bidding window")
+	}
+	revealWindow, err := strconv.Atoi(args[1])
+	if err != nil || revealWindow <= 0 {
+		return nil, errors.New("Invalid reveal window")
+	}
+
+	applicationDetails, evaluationParams, err := t.NewLoanApplication(stub, args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Lenders quote on their own through commitments instead of being asked for a quote
+	var auction SealedBidAuction
+	auction.ApplicationNumber = applicationDetails.ApplicationNumber
+	auction.BiddingDeadline = t.GetTransactionTime(stub).Add(time.Duration(biddingWindow) * time.Hour)
+	auction.RevealDeadline = auction.BiddingDeadline.Add(time.Duration(revealWindow) * time.Hour)
+	err = t.SaveSealedBidAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold suspicious or blocklisted applications for manual review before the lenders can bid
+	applicationDetails, held, err := t.HoldFlaggedApplication(stub, applicationDetails, evaluationParams)
+	if err != nil {
+		return nil, err
+	}
+	if held {
+		return json.Marshal(applicationDetails)
+	}
+
+	applicationDetails.Status = STATE_SEALED_BIDDING
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+// The commitment is the hex encoded SHA-256 hash of
+// "applicationNumber|lenderId|sanctionedAmount|interestRate|tenure|interestType|salt"
+func (t *SmartLendingChaincode) CommitSealedBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, lender id and commitment")
+	}
+
+	auction, err := t.GetSealedBidAuctionDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Application is not open for sealed bidding")
+	}
+	lenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	commitment := strings.ToLower(args[2])
+	if _, err := hex.DecodeString(commitment); err != nil || len(commitment) != sha256.Size*2 {
+		return nil, errors.New("Invalid commitment")
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	if currentTime.After(auction.BiddingDeadline) {
+		return nil, errors.New("Bidding window has closed")
+	}
+
+	// A lender may replace its commitment until the bidding window closes
+	var sealedBid SealedBidCommitment
+	sealedBid.LenderId = lenderId
+	sealedBid.Commitment = commitment
+	sealedBid.CommitDate = currentTime
+
+	var replaced bool = false
+	for i := 0; i < len(auction.Commitments); i++ {
+		if auction.Commitments[i].LenderId == lenderId {
+			auction.Commitments[i] = sealedBid
+			replaced = true
+		}
+	}
+	if !replaced {
+		auction.Commitments = append(auction.Commitments, sealedBid)
+	}
+
+	err = t.SaveSealedBidAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedBid)
+}
+
+func (t *SmartLendingChaincode) RevealSealedBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, lender id, sanctioned amount, interest rate, tenure, interest type and salt")
+	}
+
+	auction, err := t.GetSealedBidAuctionDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Application is not open for sealed bidding")
+	}
+	lenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	sanctionedAmount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || sanctionedAmount <= 0 || sanctionedAmount > applicationDetails.LoanAmount {
+		return nil, errors.New("Invalid sanctioned amount")
+	}
+	interestRate, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || interestRate <= 0 {
+		return nil, errors.New("Invalid interest rate")
+	}
+	tenure, err := strconv.Atoi(args[4])
+	if err != nil || tenure <= 0 {
+		return nil, errors.New("Invalid tenure")
+	}
+
+	currentTime := t.GetTransactionTime(stub)
+	if !currentTime.After(auction.BiddingDeadline) {
+		return nil, errors.New("Reveal window has not opened yet")
+	}
+	if currentTime.After(auction.RevealDeadline) {
+		return nil, errors.New("Reveal window has closed")
+	}
+
+	for i := 0; i < len(auction.Commitments); i++ {
+		if auction.Commitments[i].LenderId != lenderId {
+			continue
+		}
+		if auction.Commitments[i].IsRevealed {
+			return nil, errors.New("Bid has already been revealed")
+		}
+
+		// The revealed offer must hash to the commitment made in the bidding window
+		if t.HashSealedBid(args) != auction.Commitments[i].Commitment {
+			return nil, errors.New("Revealed offer does not match the commitment")
+		}
+
+		// The offer must stay within the lender's LTV and exposure limits
+		err = t.CheckLTV(stub, applicationDetails, lenderId, sanctionedAmount)
+		if err != nil {
+			return nil, err
+		}
+		err = t.CheckExposureLimits(stub, applicationDetails, lenderId, sanctionedAmount)
+		if err != nil {
+			return nil, err
+		}
+
+		var bidDetails BiddingDetails
+		bidDetails.ApplicationNumber = applicationDetails.ApplicationNumber
+		bidDetails.ApplicationAcceptStatus = LENDER_ACCEPT_APPLICATION
+		bidDetails.LenderId = lenderId
+		bidDetails.SanctionedAmount = sanctionedAmount
+		bidDetails.InterestRate = interestRate
+		bidDetails.Tenure = tenure
+		bidDetails.InterestType = args[5]
+
+		// The installment of the offer must be affordable for the applicants
+		bidDetails, err = t.CheckAffordability(stub, applicationDetails, bidDetails)
+		if err != nil {
+			return nil, err
+		}
+
+		auction.Commitments[i].IsRevealed = true
+		auction.Commitments[i].RevealDate = currentTime
+		auction.Commitments[i].RevealedOffer = bidDetails
+
+		err = t.SaveSealedBidAuction(stub, auction)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(auction.Commitments[i])
+	}
+
+	return nil, errors.New("No commitment found for the lender")
+}
+
+func (t *SmartLendingChaincode) RankSealedBids(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	auction, err := t.GetSealedBidAuctionDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+	if auction.IsRanked {
+		return nil, errors.New("Sealed bids have already been ranked")
+	}
+	if applicationDetails.Status != STATE_SEALED_BIDDING {
+		return nil, errors.New("Application is not open for sealed bidding")
+	}
+
+	// Ranking can happen once the reveal window is over or every commitment has been revealed
+	currentTime := t.GetTransactionTime(stub)
+	var allRevealed bool = len(auction.Commitments) > 0
+	for i := 0; i < len(auction.Commitments); i++ {
+		if !auction.Commitments[i].IsRevealed {
+			allRevealed = false
+		}
+	}
+	if !currentTime.After(auction.RevealDeadline) && !(allRevealed && currentTime.After(auction.BiddingDeadline)) {
+		return nil, errors.New("Reveal window is still open")
+	}
+
+	// Only the offers which were revealed against their commitments are valid
+	var revealedBids []SealedBidCommitment
+	for i := 0; i < len(auction.Commitments); i++ {
+		if auction.Commitments[i].IsRevealed {
+			revealedBids = append(revealedBids, auction.Commitments[i])
+		}
+	}
+
+	// Cheapest offer first, then the larger sanction, then the earlier commitment
+	sort.SliceStable(revealedBids, func(i, j int) bool {
+		if revealedBids[i].RevealedOffer.InterestRate != revealedBids[j].RevealedOffer.InterestRate {
+			return revealedBids[i].RevealedOffer.InterestRate < revealedBids[j].RevealedOffer.InterestRate
+		}
+		if revealedBids[i].RevealedOffer.SanctionedAmount != revealedBids[j].RevealedOffer.SanctionedAmount {
+			return revealedBids[i].RevealedOffer.SanctionedAmount > revealedBids[j].RevealedOffer.SanctionedAmount
+		}
+		return revealedBids[i].CommitDate.Before(revealedBids[j].CommitDate)
+	})
+
+	var quotes []BiddingDetails
+	for i := 0; i < len(revealedBids); i++ {
+		bidDetails := revealedBids[i].RevealedOffer
+		bidDetails.BiddingNumber, err = t.GetNextBiddingNumber(stub)
+		if err != nil {
+			return nil, err
+		}
+		bidDetails.BiddingDate = currentTime
+		bidDetails.BidValidUntil = t.GetBidValidUntil(stub, bidDetails.LenderId)
+		bidDetails.Rank = i + 1
+		quotes = append(quotes, bidDetails)
+	}
+
+	auction.IsRanked = true
+	err = t.SaveSealedBidAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationDetails.Quotations = quotes
+	applicationDetails.Status = STATE_QUOTATIONS_RECEIVED
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetSealedBidAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number")
+	}
+
+	auction, err := t.GetSealedBidAuctionDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lenders see only their own commitment
+	if caller.Role == LENDER {
+		var commitments []SealedBidCommitment
+		for i := 0; i < len(auction.Commitments); i++ {
+			if auction.Commitments[i].LenderId == caller.LenderId {
+				commitments = append(commitments, auction.Commitments[i])
+			}
+		}
+		auction.Commitments = commitments
+	}
+	return json.Marshal(auction)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetSealedBidAuctionDetails(stub shim.ChaincodeStubInterface, applicationNumber string) (SealedBidAuction, error) {
+
+	var auction SealedBidAuction
+	bytes, err := stub.GetState(SEALED_BID_AUCTION_PREFIX + applicationNumber)
+	if err != nil {
+		return auction, err
+	}
+	if bytes == nil {
+		return auction, errors.New("Could not find sealed bid auction for application")
+	}
+	err = json.Unmarshal(bytes, &auction)
+	return auction, err
+}
+
+func (t *SmartLendingChaincode) SaveSealedBidAuction(stub shim.ChaincodeStubInterface, auction SealedBidAuction) error {
+
+	bytes, err := json.Marshal(auction)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(SEALED_BID_AUCTION_PREFIX+auction.ApplicationNumber, bytes)
+}
+
+// An application held for review before its auction gets the full bidding and reveal windows from the time it
+// is cleared, false when the application was not created for sealed bidding
+func (t *SmartLendingChaincode) ReopenSealedBidAuction(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) (bool, error) {
+
+	bytes, err := stub.GetState(SEALED_BID_AUCTION_PREFIX + applicationDetails.ApplicationNumber)
+	if err != nil {
+		return false, err
+	}
+	if bytes == nil {
+		return false, nil
+	}
+	var auction SealedBidAuction
+	err = json.Unmarshal(bytes, &auction)
+	if err != nil {
+		return false, err
+	}
+
+	biddingWindow := auction.BiddingDeadline.Sub(applicationDetails.AppliedDate)
+	revealWindow := auction.RevealDeadline.Sub(auction.BiddingDeadline)
+	auction.BiddingDeadline = t.GetTransactionTime(stub).Add(biddingWindow)
+	auction.RevealDeadline = auction.BiddingDeadline.Add(revealWindow)
+	return true, t.SaveSealedBidAuction(stub, auction)
+}
+
+func (t *SmartLendingChaincode) HashSealedBid(revealArgs []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(revealArgs, "|")))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Securitization - Keys
+//==============================================================================================================================
+const POOL_PREFIX = "POOL_"
+const POOLED_LOAN_PREFIX = "POOLEDLOAN_"
+
+//==============================================================================================================================
+//	Status types - Pool
+//==============================================================================================================================
+const POOL_OPEN = "OPEN"
+const POOL_ISSUED = "ISSUED"
+
+//==============================================================================================================================
+//	Tranche classes in their order of priority in the waterfall
+//==============================================================================================================================
+const TRANCHE_SENIOR = "SENIOR"
+const TRANCHE_JUNIOR = "JUNIOR"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type LoanPool struct {
+	PoolId          string
+	Name            string
+	SponsorLenderId int
+	Status          string
+	Loans           []PooledLoan
+	Tranches        []Tranche
+	Distributions   []PoolDistribution
+	CreatedDate     time.Time
+	IssueDate       time.Time
+	// Collections already distributed whose receipts were reversed, netted off the next distribution
+	PendingReversals    []CollectionReversal
+	CollectionShortfall float64
+}
+
+type PooledLoan struct {
+	ApplicationNumber       string
+	AddedDate               time.Time
+	CollectedInstallments   []int
+	DistributedInstallments []int
+}
+
+type CollectionReversal struct {
+	ApplicationNumber string
+	InstallmentNumber int
+	PrincipalAmount   float64
+	InterestAmount    float64
+	ReversalDate      time.Time
+}
+
+type Tranche struct {
+	TrancheId            string
+	Class                string
+	Principal            float64
+	CouponRate           float64
+	OutstandingPrincipal float64
+	InterestShortfall    float64
+}
+
+type PoolDistribution struct {
+	Period              int
+	DistributionDate    time.Time
+	TransactionId       string
+	PrincipalCollected  float64
+	InterestCollected   float64
+	Reversals           []CollectionReversal
+	CollectionsReversed float64
+	TotalCollections    float64
+	PoolBalance         float64
+	PerformingLoans     int
+	NonPerformingLoans  int
+	ClosedLoans         int
+	TranchePayments     []TranchePayment
+	Residual            float64
+}
+
+type TranchePayment struct {
+	TrancheId            string
+	Class                string
+	InterestDue          float64
+	InterestPaid         float64
+	PrincipalPaid        float64
+	InterestShortfall    float64
+	OutstandingPrincipal float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the pool id, the sponsoring lender id and the pool name
+func (t *SmartLendingChaincode) CreatePool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id, lender id and name")
+	}
+	if args[0] == "" {
+		return nil, errors.New("Pool id is required")
+	}
+
+	lenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := stub.GetState(POOL_PREFIX + args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		return nil, errors.New("Pool already exists")
+	}
+
+	pool := LoanPool{PoolId: args[0], Name: args[2], SponsorLenderId: lenderId, Status: POOL_OPEN, CreatedDate: t.GetTransactionTime(stub)}
+	err = t.SavePool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pool)
+}
+
+// Arguments are the pool id and the application number of a performing loan held by the sponsor
+func (t *SmartLendingChaincode) AddLoanToPool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id and application number")
+	}
+
+	pool, err := t.GetOpenPoolForSponsor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	applicationDetails, err := t.GetApplication(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_PERFORMING {
+		return nil, errors.New("Only performing loans can be pooled")
+	}
+	if _, found := t.GetSyndicateShare(applicationDetails, pool.SponsorLenderId); !found {
+		return nil, errors.New("Sponsor does not hold the loan")
+	}
+	if t.GetLoanPoolId(stub, applicationDetails.ApplicationNumber) != "" {
+		return nil, errors.New("Loan is already pooled")
+	}
+
+	pooledLoan := PooledLoan{ApplicationNumber: applicationDetails.ApplicationNumber, AddedDate: t.GetTransactionTime(stub)}
+	// Installments recovered before pooling belong to the sponsor
+	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
+		if applicationDetails.RepaymentSchedule[i].RepaymentStatus == STATE_RECOVERED {
+			pooledLoan.CollectedInstallments = append(pooledLoan.CollectedInstallments, applicationDetails.RepaymentSchedule[i].InstallmentNumber)
+		}
+	}
+	pool.Loans = append(pool.Loans, pooledLoan)
+
+	err = stub.PutState(POOLED_LOAN_PREFIX+applicationDetails.ApplicationNumber, []byte(pool.PoolId))
+	if err != nil {
+		return nil, err
+	}
+	err = t.SavePool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pool)
+}
+
+// Arguments are the pool id, tranche id, class, principal and the annual coupon rate
+func (t *SmartLendingChaincode) AddPoolTranche(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id, tranche id, class, principal and coupon rate")
+	}
+
+	pool, err := t.GetOpenPoolForSponsor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if args[1] == "" {
+		return nil, errors.New("Tranche id is required")
+	}
+	for i := 0; i < len(pool.Tranches); i++ {
+		if pool.Tranches[i].TrancheId == args[1] {
+			return nil, errors.New("Tranche already exists")
+		}
+	}
+	if args[2] != TRANCHE_SENIOR && args[2] != TRANCHE_JUNIOR {
+		return nil, errors.New("Invalid tranche class")
+	}
+	principal, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || principal <= 0 {
+		return nil, errors.New("Invalid principal")
+	}
+	couponRate, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || couponRate < 0 {
+		return nil, errors.New("Invalid coupon rate")
+	}
+
+	tranche := Tranche{TrancheId: args[1], Class: args[2], Principal: principal, CouponRate: couponRate, OutstandingPrincipal: principal}
+	pool.Tranches = append(pool.Tranches, tranche)
+
+	err = t.SavePool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pool)
+}
+
+func (t *SmartLendingChaincode) IssuePool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id")
+	}
+
+	pool, err := t.GetOpenPoolForSponsor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(pool.Loans) == 0 || len(pool.Tranches) == 0 {
+		return nil, errors.New("Pool needs loans and tranches before issue")
+	}
+
+	// The tranches cannot be larger than the loans backing them
+	var trancheTotal float64 = 0
+	for i := 0; i < len(pool.Tranches); i++ {
+		trancheTotal = trancheTotal + pool.Tranches[i].Principal
+	}
+	poolBalance, _, _, _ := t.GetPoolBalance(stub, pool)
+	if trancheTotal > poolBalance {
+		return nil, errors.New("Tranches exceed the pool balance")
+	}
+
+	pool.Tranches = t.GetTranchesByPriority(pool.Tranches)
+	pool.Status = POOL_ISSUED
+	pool.IssueDate = t.GetTransactionTime(stub)
+
+	err = t.SavePool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pool)
+}
+
+func (t *SmartLendingChaincode) RunPoolDistribution(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id")
+	}
+
+	pool, err := t.GetPoolDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, pool.SponsorLenderId)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Status != POOL_ISSUED {
+		return nil, errors.New("Pool has not been issued")
+	}
+
+	var distribution PoolDistribution
+	distribution.Period = len(pool.Distributions) + 1
+	distribution.DistributionDate = t.GetTransactionTime(stub)
+	distribution.TransactionId = stub.GetTxID()
+
+	// Collect the sponsor's share of the installments recovered since the last distribution
+	for i := 0; i < len(pool.Loans); i++ {
+		applicationDetails, err := t.GetApplication(stub, pool.Loans[i].ApplicationNumber)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < len(applicationDetails.RepaymentSchedule); j++ {
+			installment := applicationDetails.RepaymentSchedule[j]
+			if installment.RepaymentStatus != STATE_RECOVERED || t.IsInstallmentCollected(pool.Loans[i], installment.InstallmentNumber) {
+				continue
+			}
+			for k := 0; k < len(installment.Allocations); k++ {
+				if installment.Allocations[k].LenderId == pool.SponsorLenderId {
+					distribution.PrincipalCollected = distribution.PrincipalCollected + installment.Allocations[k].PrincipalAmount
+					distribution.InterestCollected = distribution.InterestCollected + installment.Allocations[k].InterestAmount
+				}
+			}
+			pool.Loans[i].CollectedInstallments = append(pool.Loans[i].CollectedInstallments, installment.InstallmentNumber)
+			pool.Loans[i].DistributedInstallments = append(pool.Loans[i].DistributedInstallments, installment.InstallmentNumber)
+		}
+	}
+
+	// Reversed receipts are clawed back from the collections, a shortfall is carried to the next period
+	distribution.Reversals = pool.PendingReversals
+	distribution.CollectionsReversed = pool.CollectionShortfall
+	for i := 0; i < len(pool.PendingReversals); i++ {
+		distribution.CollectionsReversed = distribution.CollectionsReversed + pool.PendingReversals[i].PrincipalAmount + pool.PendingReversals[i].InterestAmount
+	}
+	pool.PendingReversals = nil
+	distribution.TotalCollections = distribution.PrincipalCollected + distribution.InterestCollected - distribution.CollectionsReversed
+	pool.CollectionShortfall = 0
+	if distribution.TotalCollections < 0 {
+		pool.CollectionShortfall = -distribution.TotalCollections
+		distribution.TotalCollections = 0
+	}
+	distribution.PoolBalance, distribution.PerformingLoans, distribution.NonPerformingLoans, distribution.ClosedLoans = t.GetPoolBalance(stub, pool)
+
+	// Pay the interest due to each tranche in order of priority
+	available := distribution.TotalCollections
+	var payments []TranchePayment
+	for i := 0; i < len(pool.Tranches); i++ {
+		var payment TranchePayment
+		payment.TrancheId = pool.Tranches[i].TrancheId
+		payment.Class = pool.Tranches[i].Class
+		payment.InterestDue = math.Floor(pool.Tranches[i].OutstandingPrincipal*pool.Tranches[i].CouponRate/12)/100 + pool.Tranches[i].InterestShortfall
+		payment.InterestPaid = math.Min(available, payment.InterestDue)
+		available = available - payment.InterestPaid
+		pool.Tranches[i].InterestShortfall = payment.InterestDue - payment.InterestPaid
+		payments = append(payments, payment)
+	}
+
+	// Then repay the principal sequentially, senior tranches first
+	for i := 0; i < len(pool.Tranches); i++ {
+		payments[i].PrincipalPaid = math.Min(available, pool.Tranches[i].OutstandingPrincipal)
+		available = available - payments[i].PrincipalPaid
+		pool.Tranches[i].OutstandingPrincipal = pool.Tranches[i].OutstandingPrincipal - payments[i].PrincipalPaid
+		payments[i].InterestShortfall = pool.Tranches[i].InterestShortfall
+		payments[i].OutstandingPrincipal = pool.Tranches[i].OutstandingPrincipal
+	}
+	distribution.TranchePayments = payments
+
+	// Whatever remains is the excess spread returned to the sponsor
+	distribution.Residual = available
+	pool.Distributions = append(pool.Distributions, distribution)
+
+	err = t.SavePool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(distribution)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetPool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id")
+	}
+
+	pool, err := t.GetPoolForViewer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// The per-period figures are available through the investor report
+	pool.Distributions = nil
+	return json.Marshal(pool)
+}
+
+// Arguments are the pool id and the period, the latest period is returned when the period is omitted
+func (t *SmartLendingChaincode) GetPoolInvestorReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pool id and optionally the period")
+	}
+
+	pool, err := t.GetPoolForViewer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(pool.Distributions) == 0 {
+		return nil, errors.New("No distributions have been made")
+	}
+
+	period := len(pool.Distributions)
+	if len(args) == 2 {
+		period, err = strconv.Atoi(args[1])
+		if err != nil || period <= 0 || period > len(pool.Distributions) {
+			return nil, errors.New("Invalid period")
+		}
+	}
+	return json.Marshal(pool.Distributions[period-1])
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetPoolDetails(stub shim.ChaincodeStubInterface, poolId string) (LoanPool, error) {
+
+	var pool LoanPool
+	bytes, err := stub.GetState(POOL_PREFIX + poolId)
+	if err != nil {
+		return pool, err
+	}
+	if bytes == nil {
+		return pool, errors.New("Could not find pool")
+	}
+	err = json.Unmarshal(bytes, &pool)
+	return pool, err
+}
+
+func (t *SmartLendingChaincode) SavePool(stub shim.ChaincodeStubInterface, pool LoanPool) error {
+
+	bytes, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(POOL_PREFIX+pool.PoolId, bytes)
+}
+
+func (t *SmartLendingChaincode) GetOpenPoolForSponsor(stub shim.ChaincodeStubInterface, poolId string) (LoanPool, error) {
+
+	pool, err := t.GetPoolDetails(stub, poolId)
+	if err != nil {
+		return pool, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return pool, err
+	}
+	err = t.CheckLenderAccess(caller, pool.SponsorLenderId)
+	if err != nil {
+		return pool, err
+	}
+	if pool.Status != POOL_OPEN {
+		return pool, errors.New("Pool has already been issued")
+	}
+	return pool, nil
+}
+
+// The pool and its investor reports are reported by the sponsor, there is no investor identity on the ledger
+func (t *SmartLendingChaincode) GetPoolForViewer(stub shim.ChaincodeStubInterface, poolId string) (LoanPool, error) {
+
+	pool, err := t.GetPoolDetails(stub, poolId)
+	if err != nil {
+		return pool, err
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return pool, err
+	}
+	if caller.Role != ADMIN {
+		err = t.CheckLenderAccess(caller, pool.SponsorLenderId)
+		if err != nil {
+			return pool, err
+		}
+	}
+	return pool, nil
+}
+
+func (t *SmartLendingChaincode) GetLoanPoolId(stub shim.ChaincodeStubInterface, applicationNumber string) string {
+	bytes, err := stub.GetState(POOLED_LOAN_PREFIX + applicationNumber)
+	if err != nil || bytes == nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+// Called when the receipt of a pooled loan's installment is reversed, an installment collected before the loan
+// was pooled belongs to the sponsor and is left alone
+func (t *SmartLendingChaincode) ReversePoolCollection(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, installment PaymentDetail) error {
+
+	poolId := t.GetLoanPoolId(stub, applicationDetails.ApplicationNumber)
+	if poolId == "" {
+		return nil
+	}
+	pool, err := t.GetPoolDetails(stub, poolId)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(pool.Loans); i++ {
+		if pool.Loans[i].ApplicationNumber != applicationDetails.ApplicationNumber {
+			continue
+		}
+		if !t.IsInstallmentDistributed(pool.Loans[i], installment.InstallmentNumber) {
+			return nil
+		}
+
+		// The installment is collected again once it is recovered
+		pool.Loans[i].CollectedInstallments = t.RemoveInstallment(pool.Loans[i].CollectedInstallments, installment.InstallmentNumber)
+		pool.Loans[i].DistributedInstallments = t.RemoveInstallment(pool.Loans[i].DistributedInstallments, installment.InstallmentNumber)
+		reversal := CollectionReversal{ApplicationNumber: applicationDetails.ApplicationNumber, InstallmentNumber: installment.InstallmentNumber, ReversalDate: t.GetTransactionTime(stub)}
+		for j := 0; j < len(installment.Allocations); j++ {
+			if installment.Allocations[j].LenderId == pool.SponsorLenderId {
+				reversal.PrincipalAmount = reversal.PrincipalAmount + installment.Allocations[j].PrincipalAmount
+				reversal.InterestAmount = reversal.InterestAmount + installment.Allocations[j].InterestAmount
+			}
+		}
+		pool.PendingReversals = append(pool.PendingReversals, reversal)
+		return t.SavePool(stub, pool)
+	}
+	return nil
+}
+
+func (t *SmartLendingChaincode) IsInstallmentDistributed(pooledLoan PooledLoan, installmentNumber int) bool {
+	for i := 0; i < len(pooledLoan.DistributedInstallments); i++ {
+		if pooledLoan.DistributedInstallments[i] == installmentNumber {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) RemoveInstallment(installments []int, installmentNumber int) []int {
+	var remaining []int
+	for i := 0; i < len(installments); i++ {
+		if installments[i] != installmentNumber {
+			remaining = append(remaining, installments[i])
+		}
+	}
+	return remaining
+}
+
+func (t *SmartLendingChaincode) IsInstallmentCollected(pooledLoan PooledLoan, installmentNumber int) bool {
+	for i := 0; i < len(pooledLoan.CollectedInstallments); i++ {
+		if pooledLoan.CollectedInstallments[i] == installmentNumber {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) GetTranchesByPriority(tranches []Tranche) []Tranche {
+
+	// Senior tranches rank ahead of junior ones, each in the order they were added
+	var ordered []Tranche
+	for i := 0; i < len(tranches); i++ {
+		if tranches[i].Class == TRANCHE_SENIOR {
+			ordered = append(ordered, tranches[i])
+		}
+	}
+	for i := 0; i < len(tranches); i++ {
+		if tranches[i].Class == TRANCHE_JUNIOR {
+			ordered = append(ordered, tranches[i])
+		}
+	}
+	return ordered
+}
+
+func (t *SmartLendingChaincode) GetPoolBalance(stub shim.ChaincodeStubInterface, pool LoanPool) (float64, int, int, int) {
+
+	var poolBalance float64 = 0
+	var performingLoans int = 0
+	var nonPerformingLoans int = 0
+	var closedLoans int = 0
+
+	for i := 0; i < len(pool.Loans); i++ {
+		applicationDetails, err := t.GetApplication(stub, pool.Loans[i].ApplicationNumber)
+		if err != nil {
+			continue
+		}
+		if applicationDetails.Status == STATE_CLOSED {
+			closedLoans++
+			continue
+		}
+		if applicationDetails.Status == STATE_WRITTEN_OFF {
+			nonPerformingLoans++
+			continue
+		}
+		if applicationDetails.Status == STATE_NON_PERFORMING {
+			nonPerformingLoans++
+		} else {
+			performingLoans++
+		}
+		holding, found := t.GetSyndicateShare(applicationDetails, pool.SponsorLenderId)
+		if found {
+			poolBalance = poolBalance + t.GetOutstandingPrincipal(applicationDetails)*holding.SharePercent/100
+		}
+	}
+
+	return poolBalance, performingLoans, nonPerformingLoans, closedLoans
+}
@@ -21,6 +21,8 @@ var logger = shim.NewLogger("CLDChaincode") // TODO : Find out what this is
 const BORROWER = "borrower"
 const DEALER = "dealer"
 const LENDER = "lender"
+const ADMIN = "admin"
+const COMPLIANCE = "compliance"
 
 //==============================================================================================================================
 //	 Status types - Loan Application
@@ -31,12 +33,21 @@ const STATE_BID_ACCEPTED = 2
 const STATE_BID_REJECTED = 3
 const STATE_PERFORMING = 4
 const STATE_NON_PERFORMING = 5
+const STATE_CLOSED = 6
+const STATE_WITHDRAWN = 7
+const STATE_EXPIRED = 8
+const STATE_SEALED_BIDDING = 9
+const STATE_PARTIALLY_DISBURSED = 10
+const STATE_WRITTEN_OFF = 11
+const STATE_MANUAL_REVIEW = 12
+const STATE_DECLINED = 13
 
 //==============================================================================================================================
 //	Status types - Lender accept status of an application
 //==============================================================================================================================
 const LENDER_ACCEPT_APPLICATION = 1
 const LENDER_REJECT_APPLICATION = 0
+const LENDER_REFER_APPLICATION = 2
 
 //==============================================================================================================================
 //	Status types - Payment status
@@ -46,6 +57,15 @@ const STATE_DEMANDED = 1
 const STATE_RECOVERED = 2
 const STATE_MISSED = 3
 
+//==============================================================================================================================
+//	 Ledger keys
+//==============================================================================================================================
+const APPLICATION_INDEX = "_applicationindex"
+const BIDDING_SEQUENCE = "_biddingsequence"
+
+// Lenders' quotes are numbered at random below this bound, bids raised later are numbered above it
+const QUOTED_BIDDING_NUMBER_RANGE = 100000
+
 //==============================================================================================================================
 //	 Structure Definitions
 //==============================================================================================================================
@@ -62,28 +82,51 @@ type SmartLendingChaincode struct {
 type LoanApplication struct {
 	ApplicationNumber string
 	AccountNumber     int
+	BorrowerId        string
+	BorrowerUsername  string
+	DealerId          string
+	VIN               string
 	Make              string
 	Model             string
 	LoanAmount        float64
-	SSN               string
-	Age               int
-	MonthlyIncome     float64
-	CreditScore       int
 	Status            int
 	Tenure            int
+	AppliedDate       time.Time
+	FraudFlags        []FraudFlag
+	FraudReview       FraudReview
+	Documents         []string
 	Transactions      []TransactionMetadata
 	Quotations        []BiddingDetails
+	Underwriting      []UnderwritingProposal
+	Negotiations      []NegotiationRound
+	Parties           []ApplicationParty
+	Participants      []SyndicateParticipant
+	TransferOffers    []LoanTransferOffer
+	OwnershipHistory  []OwnershipRecord
+	Disbursements     []Disbursement
+	DisbursedAmount   float64
+	DisbursementDate  time.Time
 	RepaymentSchedule []PaymentDetail
+	AccruedInterest   float64
+	AccruedToDate     time.Time
+	IsNonAccrual      bool
+	Fees              []LoanFee
+	WrittenOffAmount  float64
+	WriteOffDate      time.Time
+	Recoveries        []LoanRecovery
 }
 
 type EvaluationParams struct {
 	ApplicationNumber string
 	LoanAmount        float64
-	SSN               string
+	SSNHash           string
+	BorrowerName      string
 	Age               int
 	MonthlyIncome     float64
 	CreditScore       int
 	Tenure            int
+	AssetValue        float64
+	Obligations       float64
 }
 
 type BiddingDetails struct {
@@ -98,6 +141,16 @@ type BiddingDetails struct {
 	ApplicationAcceptStatus int
 	RejectionReason         string
 	IsWinningBid            bool
+	BidValidUntil           time.Time
+	IsSuperseded            bool
+	SupersededBy            int
+	Rank                    int
+	LoanToValue             float64
+	InstallmentAmount       float64
+	DebtToIncome            float64
+	ReferralReason          string
+	UnderwrittenBy          string
+	ApprovedBy              string
 }
 
 type TransactionMetadata struct {
@@ -106,6 +159,8 @@ type TransactionMetadata struct {
 	TransactionTimestamp string
 	TransactionDate      time.Time
 	CallerMetadata       []byte
+	CallerUsername       string
+	CallerRole           string
 }
 
 type PaymentDetail struct {
@@ -114,7 +169,11 @@ type PaymentDetail struct {
 	InterestAmount    float64
 	TotalEMI          float64
 	RepaymentStatus   int
+	DueDate           time.Time
 	RepaymentDate     string
+	AccruedInterest   float64
+	Accruals          []InterestAccrual
+	Allocations       []PaymentAllocation
 	Metadata          TransactionMetadata
 }
 
@@ -133,9 +192,75 @@ func (t *SmartLendingChaincode) Init(stub shim.ChaincodeStubInterface, function
 //==============================================================================================================================
 
 func (t *SmartLendingChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	// Check if the caller's role is allowed to run the query
+	err := t.CheckPermission(stub, function)
+	if err != nil {
+		return nil, err
+	}
+
 	if function == "GetApplicationDetails" {
 		fmt.Println("Calling GetLoanApplicationDetails")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting application number")
+		}
 		return t.GetLoanApplicationDetails(stub, args[0])
+	} else if function == "GetMyApplications" {
+		return t.GetMyApplications(stub, args)
+	} else if function == "GetNoDuesCertificate" {
+		return t.GetNoDuesCertificate(stub, args)
+	} else if function == "VerifyNoDuesCertificate" {
+		return t.VerifyNoDuesCertificate(stub, args)
+	} else if function == "GetLenderProduct" {
+		return t.GetLenderProductDetails(stub, args)
+	} else if function == "GetSealedBidAuction" {
+		return t.GetSealedBidAuction(stub, args)
+	} else if function == "FindApplicationsBySSN" {
+		return t.FindApplicationsBySSN(stub, args)
+	} else if function == "GetBorrower" {
+		return t.GetBorrower(stub, args)
+	} else if function == "GetBorrowerLoans" {
+		return t.GetBorrowerLoans(stub, args)
+	} else if function == "GetBorrowerExposure" {
+		return t.GetBorrowerExposure(stub, args)
+	} else if function == "GetVehicle" {
+		return t.GetVehicle(stub, args)
+	} else if function == "GetVehicleValuation" {
+		return t.GetVehicleValuation(stub, args)
+	} else if function == "GetDealer" {
+		return t.GetDealer(stub, args)
+	} else if function == "GetDealerInventory" {
+		return t.GetDealerInventory(stub, args)
+	} else if function == "GetDealerStatement" {
+		return t.GetDealerStatement(stub, args)
+	} else if function == "GetLenderPortfolio" {
+		return t.GetLenderPortfolio(stub, args)
+	} else if function == "GetLoanOwnership" {
+		return t.GetLoanOwnership(stub, args)
+	} else if function == "GetPool" {
+		return t.GetPool(stub, args)
+	} else if function == "GetPoolInvestorReport" {
+		return t.GetPoolInvestorReport(stub, args)
+	} else if function == "GetChartOfAccounts" {
+		return t.GetLenderChartOfAccounts(stub, args)
+	} else if function == "GetTrialBalance" {
+		return t.GetTrialBalance(stub, args)
+	} else if function == "GetAccountStatement" {
+		return t.GetAccountStatement(stub, args)
+	} else if function == "GetProvisioningReport" {
+		return t.GetProvisioningReport(stub, args)
+	} else if function == "GetLenderExposure" {
+		return t.GetLenderExposure(stub, args)
+	} else if function == "GetFraudRuleSettings" {
+		return t.GetFraudRuleSettingsDetails(stub, args)
+	} else if function == "GetScreeningList" {
+		return t.GetScreeningList(stub, args)
+	} else if function == "GetScreeningResults" {
+		return t.GetScreeningResults(stub, args)
+	} else if function == "GetUnderwritingQueue" {
+		return t.GetUnderwritingQueue(stub, args)
+	} else if function == "GetApplicationDocuments" {
+		return t.GetApplicationDocuments(stub, args)
 	}
 	fmt.Println("Function not found")
 	return nil, errors.New("No query functions")
@@ -146,12 +271,119 @@ func (t *SmartLendingChaincode) Query(stub shim.ChaincodeStubInterface, function
 //==============================================================================================================================
 
 func (t *SmartLendingChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	// Check if the caller's role is allowed to run the function
+	err := t.CheckPermission(stub, function)
+	if err != nil {
+		return nil, err
+	}
+
 	if function == "CreateLoanApplication" {
 		return t.CreateLoanApplication(stub, args)
 	} else if function == "ConfirmBid" {
 		return t.ConfirmBid(stub, args)
 	} else if function == "ChangePaymentStatus" {
 		return t.ChangePaymentStatus(stub, args)
+	} else if function == "WithdrawLoanApplication" {
+		return t.WithdrawLoanApplication(stub, args)
+	} else if function == "ExpireStaleApplications" {
+		return t.ExpireStaleApplications(stub, args)
+	} else if function == "SetLenderProduct" {
+		return t.SetLenderProduct(stub, args)
+	} else if function == "EraseBorrowerData" {
+		return t.EraseBorrowerData(stub, args)
+	} else if function == "UpdateKYCStatus" {
+		return t.UpdateKYCStatus(stub, args)
+	} else if function == "AddApplicationParty" {
+		return t.AddApplicationParty(stub, args)
+	} else if function == "AcceptApplicationParty" {
+		return t.AcceptApplicationParty(stub, args)
+	} else if function == "RegisterVehicle" {
+		return t.RegisterVehicle(stub, args)
+	} else if function == "SetVehicleValuation" {
+		return t.SetVehicleValuation(stub, args)
+	} else if function == "SetDepreciationCurve" {
+		return t.SetDepreciationCurve(stub, args)
+	} else if function == "RegisterDealer" {
+		return t.RegisterDealer(stub, args)
+	} else if function == "UpdateDealerStatus" {
+		return t.UpdateDealerStatus(stub, args)
+	} else if function == "SetDealerAgreement" {
+		return t.SetDealerAgreement(stub, args)
+	} else if function == "SettleDealerCommission" {
+		return t.SettleDealerCommission(stub, args)
+	} else if function == "RecordDisbursement" {
+		return t.RecordDisbursement(stub, args)
+	} else if function == "InviteSyndicateParticipant" {
+		return t.InviteSyndicateParticipant(stub, args)
+	} else if function == "AcceptSyndicateInvitation" {
+		return t.AcceptSyndicateInvitation(stub, args)
+	} else if function == "OfferLoanTransfer" {
+		return t.OfferLoanTransfer(stub, args)
+	} else if function == "AcceptLoanTransfer" {
+		return t.AcceptLoanTransfer(stub, args)
+	} else if function == "CancelLoanTransfer" {
+		return t.CancelLoanTransfer(stub, args)
+	} else if function == "CreatePool" {
+		return t.CreatePool(stub, args)
+	} else if function == "AddLoanToPool" {
+		return t.AddLoanToPool(stub, args)
+	} else if function == "AddPoolTranche" {
+		return t.AddPoolTranche(stub, args)
+	} else if function == "IssuePool" {
+		return t.IssuePool(stub, args)
+	} else if function == "RunPoolDistribution" {
+		return t.RunPoolDistribution(stub, args)
+	} else if function == "SetFraudRuleSettings" {
+		return t.SetFraudRuleSettings(stub, args)
+	} else if function == "ReviewFlaggedApplication" {
+		return t.ReviewFlaggedApplication(stub, args)
+	} else if function == "AddScreeningEntry" {
+		return t.AddScreeningEntry(stub, args)
+	} else if function == "RemoveScreeningEntry" {
+		return t.RemoveScreeningEntry(stub, args)
+	} else if function == "SetUnderwritingPolicy" {
+		return t.SetUnderwritingPolicy(stub, args)
+	} else if function == "ProposeUnderwritingTerms" {
+		return t.ProposeUnderwritingTerms(stub, args)
+	} else if function == "CheckUnderwritingTerms" {
+		return t.CheckUnderwritingTerms(stub, args)
+	} else if function == "AddDocument" {
+		return t.AddDocument(stub, args)
+	} else if function == "VerifyDocument" {
+		return t.VerifyDocument(stub, args)
+	} else if function == "SetRequiredDocuments" {
+		return t.SetRequiredDocuments(stub, args)
+	} else if function == "SetExposureLimits" {
+		return t.SetExposureLimits(stub, args)
+	} else if function == "SetProvisionRate" {
+		return t.SetProvisionRate(stub, args)
+	} else if function == "RunProvisioning" {
+		return t.RunProvisioning(stub, args)
+	} else if function == "AccrueInterest" {
+		return t.AccrueInterest(stub, args)
+	} else if function == "AddGLAccount" {
+		return t.AddGLAccount(stub, args)
+	} else if function == "ChargeLoanFee" {
+		return t.ChargeLoanFee(stub, args)
+	} else if function == "WriteOffLoan" {
+		return t.WriteOffLoan(stub, args)
+	} else if function == "RecordLoanRecovery" {
+		return t.RecordLoanRecovery(stub, args)
+	} else if function == "RequestRevisedTerms" {
+		return t.RequestRevisedTerms(stub, args)
+	} else if function == "CounterOffer" {
+		return t.CounterOffer(stub, args)
+	} else if function == "DeclineRevisedTerms" {
+		return t.DeclineRevisedTerms(stub, args)
+	} else if function == "CreateSealedBidApplication" {
+		return t.CreateSealedBidApplication(stub, args)
+	} else if function == "CommitSealedBid" {
+		return t.CommitSealedBid(stub, args)
+	} else if function == "RevealSealedBid" {
+		return t.RevealSealedBid(stub, args)
+	} else if function == "RankSealedBids" {
+		return t.RankSealedBids(stub, args)
 	}
 	fmt.Println("Function not found")
 	return nil, errors.New("Invalid invoke function name")
@@ -162,54 +394,27 @@ func (t *SmartLendingChaincode) Invoke(stub shim.ChaincodeStubInterface, functio
 //==============================================================================================================================
 func (t *SmartLendingChaincode) CreateLoanApplication(stub shim.ChaincodeStubInterface, applicationArgs []string) ([]byte, error) {
 
-	// Validate the application details
-	if applicationArgs[0] == "" {
-		fmt.Printf("Invalid application")
-		return nil, errors.New("Invalid application")
+	// Save the loan application
+	applicationDetails, evaluationParams, err := t.NewLoanApplication(stub, applicationArgs)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check if the application already exist
-	bytes, err := stub.GetState(applicationArgs[0])
-	if bytes != nil {
-		return nil, errors.New("Application already exist")
+	// Hold suspicious or blocklisted applications for manual review instead of asking the lenders
+	applicationDetails, held, err := t.HoldFlaggedApplication(stub, applicationDetails, evaluationParams)
+	if err != nil {
+		return nil, err
+	}
+	if held {
+		return json.Marshal(applicationDetails)
 	}
-
-	// Construct the application details
-	var applicationNumber string = applicationArgs[0]
-	var make string = applicationArgs[1]
-	var model string = applicationArgs[2]
-	loanAmount, err := strconv.ParseFloat(applicationArgs[3], 64)
-	var ssn string = applicationArgs[4]
-	age, err := strconv.Atoi(applicationArgs[5])
-	monthlyIncome, err := strconv.ParseFloat(applicationArgs[6], 64)
-	creditScore, err := strconv.Atoi(applicationArgs[7])
-	loanTenure, err := strconv.Atoi(applicationArgs[8])
-
-	applicationDetails := LoanApplication{ApplicationNumber: applicationNumber, Make: make, Model: model, LoanAmount: loanAmount, SSN: ssn, Age: age, MonthlyIncome: monthlyIncome, CreditScore: creditScore, Status: STATE_APPLIED}
-
-	// Save the loan application
-	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
-
-	// Prepare the evaluation parameters
-	evaluationParams := EvaluationParams{ApplicationNumber: applicationNumber, LoanAmount: loanAmount, SSN: ssn, Age: age, MonthlyIncome: monthlyIncome, CreditScore: creditScore, Tenure: loanTenure}
 
 	// Get quotes from lenders
-	quoteFromLender1 := t.GetQuoteFromLender1(evaluationParams)
-	quoteFromLender2 := t.GetQuoteFromLender2(evaluationParams)
-	quoteFromLender3 := t.GetQuoteFromLender3(evaluationParams)
-	quoteFromLender4 := t.GetQuoteFromLender4(evaluationParams)
-
-	// Add the quotations to the loan application
-	var quotes []BiddingDetails
-	quotes = append(quotes, quoteFromLender1)
-	quotes = append(quotes, quoteFromLender2)
-	quotes = append(quotes, quoteFromLender3)
-	quotes = append(quotes, quoteFromLender4)
-	applicationDetails.Quotations = quotes
+	applicationDetails.Quotations = t.GetQuotesFromLenders(stub, applicationDetails, evaluationParams)
 	applicationDetails.Status = STATE_QUOTATIONS_RECEIVED
 	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
 
-	bytes, err = json.Marshal(applicationDetails)
+	bytes, err := json.Marshal(applicationDetails)
 
 	return bytes, err
 }
@@ -225,20 +430,85 @@ func (t *SmartLendingChaincode) ConfirmBid(stub shim.ChaincodeStubInterface, app
 
 	if err != nil {
 		fmt.Println("Error while coverting JSON: " + err.Error())
+		return nil, errors.New("Could not find application")
+	}
+
+	// Only the borrower of the application can confirm a bid
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckApplicationAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	if applicationDetails.Status != STATE_QUOTATIONS_RECEIVED {
+		return nil, errors.New("Application is not awaiting bid confirmation")
+	}
+	if bidStatus != STATE_BID_ACCEPTED && bidStatus != STATE_BID_REJECTED {
+		return nil, errors.New("Invalid bid status")
+	}
+
+	// Only a live bid from a lender who accepted the application can be accepted
+	if bidStatus == STATE_BID_ACCEPTED {
+		var bidFound bool = false
+		var bidSuperseded bool = false
+		for i := 0; i < len(applicationDetails.Quotations); i++ {
+			if applicationDetails.Quotations[i].BiddingNumber == biddingNumber && applicationDetails.Quotations[i].ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION {
+				if applicationDetails.Quotations[i].IsSuperseded {
+					bidSuperseded = true
+					continue
+				}
+				bidFound = true
+				if t.IsBidExpired(applicationDetails.Quotations[i], t.GetTransactionTime(stub)) {
+					return nil, errors.New("Bid has expired")
+				}
+
+				// The borrower's obligations and the lender's exposure may have grown since it quoted
+				_, err = t.CheckAffordability(stub, applicationDetails, applicationDetails.Quotations[i])
+				if err != nil {
+					return nil, err
+				}
+				err = t.CheckExposureLimits(stub, applicationDetails, applicationDetails.Quotations[i].LenderId, applicationDetails.Quotations[i].SanctionedAmount)
+				if err != nil {
+					return nil, err
+				}
+				err = t.CheckRequiredDocuments(stub, applicationDetails, applicationDetails.Quotations[i].LenderId)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !bidFound && bidSuperseded {
+			return nil, errors.New("Bid has been superseded by a counter-offer")
+		}
+		if !bidFound {
+			return nil, errors.New("Bid not found")
+		}
 	}
 
 	applicationDetails.Status = bidStatus
 
 	for i := 0; i < len(applicationDetails.Quotations); i++ {
-		if applicationDetails.Quotations[i].BiddingNumber == biddingNumber && bidStatus == STATE_BID_ACCEPTED {
+		if applicationDetails.Quotations[i].BiddingNumber == biddingNumber && applicationDetails.Quotations[i].ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION && !applicationDetails.Quotations[i].IsSuperseded && bidStatus == STATE_BID_ACCEPTED {
 			applicationDetails.Quotations[i].IsWinningBid = true
+
+			// Register the winning lender's lien on the vehicle
+			err = t.RegisterLien(stub, applicationDetails, applicationDetails.Quotations[i])
+			if err != nil {
+				return nil, err
+			}
+
+			// The repayment schedule is generated once the lender disburses the loan
 			applicationDetails.AccountNumber = t.GenerateAccountNumber()
-			applicationDetails.RepaymentSchedule = t.GenerateRepaymentSchedule(applicationDetails.Quotations[i])
 		}
 	}
 
 	fmt.Println("after setting bid")
 
+	applicationDetails = t.CloseOpenNegotiations(applicationDetails)
+
 	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
 
 	bytes, err = json.Marshal(applicationDetails)
@@ -254,14 +524,59 @@ func (t *SmartLendingChaincode) ChangePaymentStatus(stub shim.ChaincodeStubInter
 	repaymentStatus, err := strconv.Atoi(applicationArgs[3])
 
 	// Get the application details
-	var applicationDetails LoanApplication
-	bytes, err := stub.GetState(applicationNumber)
-	err = json.Unmarshal(bytes, &applicationDetails)
+	applicationDetails, err := t.GetApplication(stub, applicationNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the servicing lender can record the payments of the loan
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	_, found := t.GetWinningBid(applicationDetails)
+	if !found {
+		return nil, errors.New("Loan has not been booked")
+	}
+	err = t.CheckLenderAccess(caller, t.GetServicingLenderId(applicationDetails, t.GetTransactionTime(stub)))
+	if err != nil {
+		return nil, err
+	}
+
+	if applicationDetails.Status == STATE_CLOSED {
+		return nil, errors.New("Loan is already closed")
+	}
+	if applicationDetails.Status == STATE_WRITTEN_OFF {
+		return nil, errors.New("Loan has been written off")
+	}
+	if !t.IsLoanDisbursed(applicationDetails) {
+		return nil, errors.New("Loan has not been fully disbursed")
+	}
 
 	// Loop through the repayment schedule and change the payment status
 	for i := 0; i < len(applicationDetails.RepaymentSchedule); i++ {
 		if applicationDetails.RepaymentSchedule[i].InstallmentNumber == installmentNumber {
+			previousRepaymentStatus := applicationDetails.RepaymentSchedule[i].RepaymentStatus
 			applicationDetails.RepaymentSchedule[i].RepaymentStatus = repaymentStatus
+
+			// Split a recovered installment across the lenders holding the loan and post it to their ledgers
+			if repaymentStatus == STATE_RECOVERED && previousRepaymentStatus != STATE_RECOVERED {
+				applicationDetails.RepaymentSchedule[i].Allocations = t.AllocateRepayment(applicationDetails, applicationDetails.RepaymentSchedule[i])
+				applicationDetails.RepaymentSchedule[i], err = t.PostRepaymentReceipt(stub, applicationDetails, applicationDetails.RepaymentSchedule[i])
+				if err != nil {
+					return nil, err
+				}
+			} else if repaymentStatus != STATE_RECOVERED && previousRepaymentStatus == STATE_RECOVERED {
+				err = t.PostRepaymentReversal(stub, applicationDetails, applicationDetails.RepaymentSchedule[i])
+				if err != nil {
+					return nil, err
+				}
+				err = t.ReversePoolCollection(stub, applicationDetails, applicationDetails.RepaymentSchedule[i])
+				if err != nil {
+					return nil, err
+				}
+				applicationDetails.RepaymentSchedule[i].Allocations = nil
+			}
 			var metadata TransactionMetadata
 			metadata.TransactionId = stub.GetTxID()
 			txnTimeStamp, err := stub.GetTxTimestamp()
@@ -276,24 +591,66 @@ func (t *SmartLendingChaincode) ChangePaymentStatus(stub shim.ChaincodeStubInter
 	}
 
 	// Get the revised loan application status
+	previousStatus := applicationDetails.Status
 	applicationDetails = t.CheckLoanDefaultStatus(applicationDetails)
-	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
 
-	bytes, err = json.Marshal(applicationDetails)
+	// Stop recognising interest on a non performing loan
+	applicationDetails, err = t.UpdateAccrualStatus(stub, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	notification := LoanStatusNotification{ApplicationNumber: applicationDetails.ApplicationNumber}
+
+	// Hold the guarantors liable once the loan turns non performing
+	if previousStatus != STATE_NON_PERFORMING && applicationDetails.Status == STATE_NON_PERFORMING {
+		applicationDetails, notification.Guarantee, err = t.InvokeGuarantees(stub, applicationDetails)
+		if err != nil {
+			return nil, err
+		}
+		notification.GuaranteesInvoked = len(notification.Guarantee.Guarantors) > 0
+	}
+
+	// Close the loan once all the dues are settled
+	if t.IsLoanFullyRepaid(applicationDetails) {
+		applicationDetails, notification.NoDuesCertificate, err = t.CloseLoan(stub, applicationDetails)
+		if err != nil {
+			return nil, err
+		}
+		notification.LoanClosed = true
+	} else {
+		applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+	}
+
+	notification.Status = applicationDetails.Status
+	err = t.RaiseLoanStatusEvent(stub, notification)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(applicationDetails)
 
 	return bytes, err
 }
 
 func (t *SmartLendingChaincode) GetLoanApplicationDetails(stub shim.ChaincodeStubInterface, applicationNumber string) ([]byte, error) {
 
-	bytes, err := stub.GetState(applicationNumber)
+	applicationDetails, err := t.GetApplication(stub, applicationNumber)
 	if err != nil {
 		return nil, err
 	}
-	if bytes == nil {
-		return nil, errors.New("Could not find application")
+
+	// Dealers and borrowers see only their own applications
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
 	}
-	return bytes, err
+	err = t.CheckApplicationViewAccess(caller, applicationDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(t.FilterApplicationForCaller(stub, caller, applicationDetails))
 }
 
 //==============================================================================================================================
@@ -337,9 +694,254 @@ func (t *SmartLendingChaincode) GetTransactionMetadata(stub shim.ChaincodeStubIn
 	callerMetadata, err := stub.GetCallerMetadata()
 
 	metadata.CallerMetadata = callerMetadata
+	caller, err := t.GetCallerDetails(stub)
+	if err == nil {
+		metadata.CallerUsername = caller.Username
+		metadata.CallerRole = caller.Role
+	}
 	return metadata
 }
 
+func (t *SmartLendingChaincode) NewLoanApplication(stub shim.ChaincodeStubInterface, applicationArgs []string) (LoanApplication, EvaluationParams, error) {
+
+	var applicationDetails LoanApplication
+	var evaluationParams EvaluationParams
+
+	// Validate the application details
+	// Arguments 9 and 10 are the optional dealer id and borrower username, argument 11 is the id of the
+	// borrower's data key, argument 12 is the borrower's name which is screened and not kept, argument 13 is
+	// the VIN of a registered vehicle and argument 14 is the borrower's details encrypted under the data key.
+	// The data key id and the encrypted details are needed only on the borrower's first application
+	if len(applicationArgs) < 9 || applicationArgs[0] == "" {
+		fmt.Printf("Invalid application")
+		return applicationDetails, evaluationParams, errors.New("Invalid application")
+	}
+	if len(applicationArgs) < 13 || applicationArgs[12] == "" {
+		return applicationDetails, evaluationParams, errors.New("Borrower name is required for screening")
+	}
+
+	// Check if the application already exist
+	bytes, err := stub.GetState(applicationArgs[0])
+	if bytes != nil {
+		return applicationDetails, evaluationParams, errors.New("Application already exist")
+	}
+
+	// Construct the application details
+	var applicationNumber string = applicationArgs[0]
+	var make string = applicationArgs[1]
+	var model string = applicationArgs[2]
+	loanAmount, err := strconv.ParseFloat(applicationArgs[3], 64)
+	var ssnHash string = applicationArgs[4]
+	age, err := strconv.Atoi(applicationArgs[5])
+	monthlyIncome, err := strconv.ParseFloat(applicationArgs[6], 64)
+	creditScore, err := strconv.Atoi(applicationArgs[7])
+	loanTenure, err := strconv.Atoi(applicationArgs[8])
+
+	applicationDetails = LoanApplication{ApplicationNumber: applicationNumber, Make: make, Model: model, LoanAmount: loanAmount, Tenure: loanTenure, Status: STATE_APPLIED}
+	applicationDetails.AppliedDate = t.GetTransactionTime(stub)
+
+	// Record who the application belongs to
+	applicationDetails.BorrowerUsername, applicationDetails.DealerId, err = t.GetApplicationParties(stub, applicationArgs)
+	if err != nil {
+		return applicationDetails, evaluationParams, err
+	}
+
+	// Take the vehicle details from the registry when the VIN is given
+	if len(applicationArgs) > 13 && applicationArgs[13] != "" {
+		vehicle, err := t.GetVehicleDetails(stub, applicationArgs[13])
+		if err != nil {
+			return applicationDetails, evaluationParams, err
+		}
+		if applicationDetails.DealerId != "" && vehicle.DealerId != applicationDetails.DealerId {
+			return applicationDetails, evaluationParams, errors.New("Vehicle is not listed by the dealer")
+		}
+		applicationDetails.VIN = vehicle.VIN
+		applicationDetails.Make = vehicle.Make
+		applicationDetails.Model = vehicle.Model
+	}
+
+	// Link the application to the borrower's profile
+	var encryptedPII string = ""
+	if len(applicationArgs) > 14 {
+		encryptedPII = applicationArgs[14]
+	}
+	borrowerProfile := BorrowerProfile{Age: age, MonthlyIncome: monthlyIncome, CreditScore: creditScore}
+	borrower, err := t.RegisterBorrower(stub, applicationDetails.BorrowerUsername, applicationNumber, PARTY_PRIMARY, ssnHash, borrowerProfile, applicationArgs[11], encryptedPII)
+	if err != nil {
+		return applicationDetails, evaluationParams, err
+	}
+	applicationDetails.BorrowerId = borrower.BorrowerId
+
+	// Save the loan application
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+	err = t.AddToApplicationIndex(stub, applicationNumber)
+	if err != nil {
+		return applicationDetails, evaluationParams, err
+	}
+	if applicationDetails.DealerId != "" {
+		err = t.AddToDealerApplications(stub, applicationDetails.DealerId, applicationNumber)
+		if err != nil {
+			return applicationDetails, evaluationParams, err
+		}
+	}
+
+	// Prepare the evaluation parameters
+	evaluationParams = EvaluationParams{ApplicationNumber: applicationNumber, LoanAmount: loanAmount, SSNHash: borrower.SSNHash, BorrowerName: applicationArgs[12], Age: age, MonthlyIncome: monthlyIncome, CreditScore: creditScore, Tenure: loanTenure}
+	evaluationParams.AssetValue = t.GetAssetValue(stub, applicationDetails)
+	evaluationParams.Obligations = t.GetMonthlyObligations(stub, applicationDetails.BorrowerId, applicationNumber)
+
+	return applicationDetails, evaluationParams, nil
+}
+
+func (t *SmartLendingChaincode) GetApplicationParties(stub shim.ChaincodeStubInterface, applicationArgs []string) (string, string, error) {
+
+	var dealerId string = ""
+	var borrowerUsername string = ""
+	if len(applicationArgs) > 9 {
+		dealerId = applicationArgs[9]
+	}
+	if len(applicationArgs) > 10 {
+		borrowerUsername = applicationArgs[10]
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Borrowers apply for themselves while dealers originate on behalf of a borrower
+	if caller.Role == BORROWER {
+		if borrowerUsername != "" && borrowerUsername != caller.Username {
+			return "", "", errors.New("Borrowers can only apply for themselves")
+		}
+		borrowerUsername = caller.Username
+	} else if caller.Role == DEALER {
+		if dealerId != "" && dealerId != caller.Username {
+			return "", "", errors.New("Dealers can only originate their own applications")
+		}
+		dealerId = caller.Username
+		if borrowerUsername == "" {
+			return "", "", errors.New("Borrower username is required")
+		}
+	} else {
+		return "", "", errors.New("Only borrowers and dealers can create applications")
+	}
+
+	// Applications can only be originated through a registered dealer
+	if dealerId != "" {
+		_, err = t.GetActiveDealer(stub, dealerId)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return borrowerUsername, dealerId, nil
+}
+
+func (t *SmartLendingChaincode) GetQuotesFromLenders(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, evaluationParams EvaluationParams) []BiddingDetails {
+
+	// Get quotes from lenders
+	quoteFromLender1 := t.GetQuoteFromLender1(evaluationParams)
+	quoteFromLender2 := t.GetQuoteFromLender2(evaluationParams)
+	quoteFromLender3 := t.GetQuoteFromLender3(evaluationParams)
+	quoteFromLender4 := t.GetQuoteFromLender4(evaluationParams)
+
+	// Add the quotations to the loan application
+	var quotes []BiddingDetails
+	quotes = append(quotes, quoteFromLender1)
+	quotes = append(quotes, quoteFromLender2)
+	quotes = append(quotes, quoteFromLender3)
+	quotes = append(quotes, quoteFromLender4)
+
+	// Apply the LTV, affordability and exposure limits, refer the bids of lenders underwriting manually and
+	// stamp the validity of the bids as per the lender products
+	for i := 0; i < len(quotes); i++ {
+		quotes[i] = t.ApplyLTVPolicy(stub, quotes[i], evaluationParams)
+		quotes[i] = t.ApplyAffordabilityPolicy(stub, quotes[i], evaluationParams)
+		quotes[i] = t.ApplyExposureLimits(stub, quotes[i], applicationDetails)
+		quotes[i] = t.ApplyUnderwritingReferral(stub, quotes[i], evaluationParams)
+		if quotes[i].ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION {
+			quotes[i].BidValidUntil = t.GetBidValidUntil(stub, quotes[i].LenderId)
+		}
+	}
+
+	return quotes
+}
+
+func (t *SmartLendingChaincode) GetApplication(stub shim.ChaincodeStubInterface, applicationNumber string) (LoanApplication, error) {
+
+	var applicationDetails LoanApplication
+	bytes, err := stub.GetState(applicationNumber)
+	if err != nil {
+		return applicationDetails, err
+	}
+	if bytes == nil {
+		return applicationDetails, errors.New("Could not find application")
+	}
+	err = json.Unmarshal(bytes, &applicationDetails)
+	if err != nil {
+		return applicationDetails, err
+	}
+	return applicationDetails, nil
+}
+
+func (t *SmartLendingChaincode) GetApplicationIndex(stub shim.ChaincodeStubInterface) ([]string, error) {
+
+	var applicationIndex []string
+	bytes, err := stub.GetState(APPLICATION_INDEX)
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &applicationIndex)
+	}
+	return applicationIndex, err
+}
+
+func (t *SmartLendingChaincode) AddToApplicationIndex(stub shim.ChaincodeStubInterface, applicationNumber string) error {
+
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return err
+	}
+	applicationIndex = append(applicationIndex, applicationNumber)
+
+	bytes, err := json.Marshal(applicationIndex)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(APPLICATION_INDEX, bytes)
+}
+
+func (t *SmartLendingChaincode) GetNextSequence(stub shim.ChaincodeStubInterface, sequenceKey string) (int, error) {
+
+	var sequence int = 0
+	bytes, err := stub.GetState(sequenceKey)
+	if err != nil {
+		return 0, err
+	}
+	if bytes != nil {
+		sequence, err = strconv.Atoi(string(bytes))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sequence++
+	err = stub.PutState(sequenceKey, []byte(strconv.Itoa(sequence)))
+	return sequence, err
+}
+
+func (t *SmartLendingChaincode) GetTransactionTime(stub shim.ChaincodeStubInterface) time.Time {
+
+	// Use the transaction timestamp so that every peer arrives at the same time
+	txnTimeStamp, err := stub.GetTxTimestamp()
+	if err != nil || txnTimeStamp == nil {
+		return time.Now().UTC()
+	}
+	return time.Unix(txnTimeStamp.Seconds, int64(txnTimeStamp.Nanos)).UTC()
+}
+
 func (t *SmartLendingChaincode) GetQuoteFromLender1(evaluationParams EvaluationParams) BiddingDetails {
 
 	var bidDetails BiddingDetails
@@ -354,7 +956,7 @@ func (t *SmartLendingChaincode) GetQuoteFromLender1(evaluationParams EvaluationP
 	} else if evaluationParams.Age < 18 {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Not meeting age requirements"
-	} else if utf8.RuneCountInString(evaluationParams.SSN) != 7 {
+	} else if utf8.RuneCountInString(evaluationParams.SSNHash) != SSN_HASH_LENGTH {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Invalid SSN"
 	} else if evaluationParams.MonthlyIncome < 1000.00 {
@@ -415,7 +1017,7 @@ func (t *SmartLendingChaincode) GetQuoteFromLender2(evaluationParams EvaluationP
 	} else if evaluationParams.Age < 18 {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Not meeting age requirements"
-	} else if utf8.RuneCountInString(evaluationParams.SSN) != 7 {
+	} else if utf8.RuneCountInString(evaluationParams.SSNHash) != SSN_HASH_LENGTH {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Invalid SSN"
 	} else if evaluationParams.MonthlyIncome < 1000.00 {
@@ -476,7 +1078,7 @@ func (t *SmartLendingChaincode) GetQuoteFromLender3(evaluationParams EvaluationP
 	} else if evaluationParams.Age < 18 {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Not meeting age requirements"
-	} else if utf8.RuneCountInString(evaluationParams.SSN) != 7 {
+	} else if utf8.RuneCountInString(evaluationParams.SSNHash) != SSN_HASH_LENGTH {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Invalid SSN"
 	} else if evaluationParams.MonthlyIncome < 1000.00 {
@@ -537,7 +1139,7 @@ func (t *SmartLendingChaincode) GetQuoteFromLender4(evaluationParams EvaluationP
 	} else if evaluationParams.Age < 18 {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Not meeting age requirements"
-	} else if utf8.RuneCountInString(evaluationParams.SSN) != 7 {
+	} else if utf8.RuneCountInString(evaluationParams.SSNHash) != SSN_HASH_LENGTH {
 		bidDetails.ApplicationAcceptStatus = LENDER_REJECT_APPLICATION
 		bidDetails.RejectionReason = "Invalid SSN"
 	} else if evaluationParams.MonthlyIncome < 1000.00 {
@@ -588,11 +1190,21 @@ func (t *SmartLendingChaincode) GenerateBiddingNumber() int {
 	var biddingNumber int = 0
 
 	// TODO : Store max bid number used in ledger and return the next number and remove random generation
-	biddingNumber = rand.Intn(100000)
+	biddingNumber = rand.Intn(QUOTED_BIDDING_NUMBER_RANGE)
 
 	return biddingNumber
 }
 
+// Counter-offers and ranked sealed bids take the next number from the ledger, so every peer assigns the same
+// number and it cannot collide with a quoted bid
+func (t *SmartLendingChaincode) GetNextBiddingNumber(stub shim.ChaincodeStubInterface) (int, error) {
+	sequence, err := t.GetNextSequence(stub, BIDDING_SEQUENCE)
+	if err != nil {
+		return 0, err
+	}
+	return QUOTED_BIDDING_NUMBER_RANGE + sequence, nil
+}
+
 func (t *SmartLendingChaincode) GenerateAccountNumber() int {
 	var accountNumber int = 0
 
@@ -602,7 +1214,7 @@ func (t *SmartLendingChaincode) GenerateAccountNumber() int {
 	return accountNumber
 }
 
-func (t *SmartLendingChaincode) GenerateRepaymentSchedule(winningQuotation BiddingDetails) []PaymentDetail {
+func (t *SmartLendingChaincode) GenerateRepaymentSchedule(winningQuotation BiddingDetails, disbursedAmount float64, disbursementDate time.Time) []PaymentDetail {
 	var repaymentSchedule []PaymentDetail
 	var noOfInstallments int
 
@@ -614,10 +1226,11 @@ func (t *SmartLendingChaincode) GenerateRepaymentSchedule(winningQuotation Biddi
 		var installmentDetail PaymentDetail
 
 		installmentDetail.InstallmentNumber = i + 1
-		installmentDetail.PrincipalAmount = winningQuotation.SanctionedAmount / float64(noOfInstallments)
+		installmentDetail.PrincipalAmount = disbursedAmount / float64(noOfInstallments)
 		installmentDetail.InterestAmount = (installmentDetail.PrincipalAmount * winningQuotation.InterestRate) / float64(100)
 		installmentDetail.TotalEMI = installmentDetail.PrincipalAmount + installmentDetail.InterestAmount
 		installmentDetail.RepaymentStatus = STATE_DEMANDED
+		installmentDetail.DueDate = disbursementDate.AddDate(0, i+1, 0)
 		repaymentSchedule = append(repaymentSchedule, installmentDetail)
 	}
 
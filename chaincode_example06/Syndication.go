@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Status types - Syndicate participant
+//==============================================================================================================================
+const PARTICIPANT_INVITED = "INVITED"
+const PARTICIPANT_ACTIVE = "ACTIVE"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type SyndicateParticipant struct {
+	LenderId     int
+	SharePercent float64
+	Status       string
+	IsLead       bool
+	InvitedDate  time.Time
+	JoinedDate   time.Time
+}
+
+type PaymentAllocation struct {
+	LenderId        int
+	SharePercent    float64
+	PrincipalAmount float64
+	InterestAmount  float64
+	TotalAmount     float64
+}
+
+type LenderPortfolio struct {
+	LenderId             int
+	Loans                []PortfolioLoan
+	TotalSanctioned      float64
+	OutstandingPrincipal float64
+	PrincipalReceived    float64
+	InterestReceived     float64
+}
+
+type PortfolioLoan struct {
+	ApplicationNumber    string
+	Status               int
+	SharePercent         float64
+	IsLead               bool
+	SanctionedAmount     float64
+	OutstandingPrincipal float64
+	PrincipalReceived    float64
+	InterestReceived     float64
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the application number, the invited lender id and the share of the loan in percent
+func (t *SmartLendingChaincode) InviteSyndicateParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, lender id and share percent")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	lenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	sharePercent, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || sharePercent <= 0 || sharePercent >= 100 {
+		return nil, errors.New("Invalid share percent")
+	}
+
+	// Only the lead lender can syndicate the loan and only before it is disbursed
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	winningBid, found := t.GetWinningBid(applicationDetails)
+	if !found {
+		return nil, errors.New("Loan has not been booked")
+	}
+	err = t.CheckLenderAccess(caller, winningBid.LenderId)
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_BID_ACCEPTED {
+		return nil, errors.New("Loan can only be syndicated before disbursement")
+	}
+	if lenderId == winningBid.LenderId {
+		return nil, errors.New("Lead lender cannot be invited")
+	}
+
+	applicationDetails.Participants = t.GetSyndicateParticipants(applicationDetails)
+	currentTime := t.GetTransactionTime(stub)
+	var invited bool = false
+	for i := 0; i < len(applicationDetails.Participants); i++ {
+		if applicationDetails.Participants[i].LenderId != lenderId {
+			continue
+		}
+		if applicationDetails.Participants[i].Status == PARTICIPANT_ACTIVE {
+			return nil, errors.New("Lender is already a participant")
+		}
+		// A fresh invitation replaces the open one
+		applicationDetails.Participants[i].SharePercent = sharePercent
+		applicationDetails.Participants[i].InvitedDate = currentTime
+		invited = true
+	}
+	if !invited {
+		participant := SyndicateParticipant{LenderId: lenderId, SharePercent: sharePercent, Status: PARTICIPANT_INVITED, InvitedDate: currentTime}
+		applicationDetails.Participants = append(applicationDetails.Participants, participant)
+	}
+
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails.Participants)
+}
+
+func (t *SmartLendingChaincode) AcceptSyndicateInvitation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number and lender id")
+	}
+
+	applicationDetails, err := t.GetApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	lenderId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	if applicationDetails.Status != STATE_BID_ACCEPTED {
+		return nil, errors.New("Loan can only be syndicated before disbursement")
+	}
+
+	// The participant's share is carved out of the lead lender's share
+	for i := 0; i < len(applicationDetails.Participants); i++ {
+		if applicationDetails.Participants[i].LenderId != lenderId || applicationDetails.Participants[i].Status != PARTICIPANT_INVITED {
+			continue
+		}
+		for j := 0; j < len(applicationDetails.Participants); j++ {
+			if !applicationDetails.Participants[j].IsLead {
+				continue
+			}
+			if applicationDetails.Participants[j].SharePercent <= applicationDetails.Participants[i].SharePercent {
+				return nil, errors.New("Lead lender does not hold enough of the loan")
+			}
+			applicationDetails.Participants[j].SharePercent = applicationDetails.Participants[j].SharePercent - applicationDetails.Participants[i].SharePercent
+		}
+
+		// Joining must keep the participant within its own exposure limits
+		winningBid, _ := t.GetWinningBid(applicationDetails)
+		err = t.CheckExposureLimits(stub, applicationDetails, lenderId, winningBid.SanctionedAmount*applicationDetails.Participants[i].SharePercent/100)
+		if err != nil {
+			return nil, err
+		}
+		applicationDetails.Participants[i].Status = PARTICIPANT_ACTIVE
+		applicationDetails.Participants[i].JoinedDate = t.GetTransactionTime(stub)
+
+		applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+		return json.Marshal(applicationDetails.Participants)
+	}
+
+	return nil, errors.New("No open invitation for the lender")
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetLenderPortfolio(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role != ADMIN {
+		err = t.CheckLenderAccess(caller, lenderId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each lender sees only its own share of the loans it holds or has received payments from
+	portfolio := LenderPortfolio{LenderId: lenderId}
+	currentTime := t.GetTransactionTime(stub)
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil {
+			continue
+		}
+		winningBid, found := t.GetWinningBid(applicationDetails)
+		if !found {
+			continue
+		}
+
+		var loan PortfolioLoan
+		loan.ApplicationNumber = applicationDetails.ApplicationNumber
+		loan.Status = applicationDetails.Status
+		holdings := t.GetHoldingsAsOf(applicationDetails, currentTime)
+		for j := 0; j < len(holdings); j++ {
+			if holdings[j].LenderId == lenderId {
+				loan.SharePercent = holdings[j].SharePercent
+				loan.IsLead = holdings[j].IsLead
+			}
+		}
+		loan.SanctionedAmount = winningBid.SanctionedAmount * loan.SharePercent / 100
+		loan.OutstandingPrincipal = t.GetOutstandingPrincipal(applicationDetails) * loan.SharePercent / 100
+		for j := 0; j < len(applicationDetails.RepaymentSchedule); j++ {
+			allocations := applicationDetails.RepaymentSchedule[j].Allocations
+			for k := 0; k < len(allocations); k++ {
+				if allocations[k].LenderId == lenderId {
+					loan.PrincipalReceived = loan.PrincipalReceived + allocations[k].PrincipalAmount
+					loan.InterestReceived = loan.InterestReceived + allocations[k].InterestAmount
+				}
+			}
+		}
+
+		if loan.SharePercent <= 0 && loan.PrincipalReceived == 0 && loan.InterestReceived == 0 {
+			continue
+		}
+
+		portfolio.Loans = append(portfolio.Loans, loan)
+		portfolio.TotalSanctioned = portfolio.TotalSanctioned + loan.SanctionedAmount
+		portfolio.OutstandingPrincipal = portfolio.OutstandingPrincipal + loan.OutstandingPrincipal
+		portfolio.PrincipalReceived = portfolio.PrincipalReceived + loan.PrincipalReceived
+		portfolio.InterestReceived = portfolio.InterestReceived + loan.InterestReceived
+	}
+
+	return json.Marshal(portfolio)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetSyndicateParticipants(applicationDetails LoanApplication) []SyndicateParticipant {
+
+	// An unsyndicated loan is held entirely by the winning lender
+	if len(applicationDetails.Participants) > 0 {
+		return applicationDetails.Participants
+	}
+	winningBid, found := t.GetWinningBid(applicationDetails)
+	if !found {
+		return nil
+	}
+	lead := SyndicateParticipant{LenderId: winningBid.LenderId, SharePercent: 100, Status: PARTICIPANT_ACTIVE, IsLead: true}
+	return []SyndicateParticipant{lead}
+}
+
+func (t *SmartLendingChaincode) GetSyndicateShare(applicationDetails LoanApplication, lenderId int) (SyndicateParticipant, bool) {
+	participants := t.GetSyndicateParticipants(applicationDetails)
+	for i := 0; i < len(participants); i++ {
+		if participants[i].LenderId == lenderId && participants[i].Status == PARTICIPANT_ACTIVE && participants[i].SharePercent > 0 {
+			return participants[i], true
+		}
+	}
+	return SyndicateParticipant{}, false
+}
+
+func (t *SmartLendingChaincode) AllocateRepayment(applicationDetails LoanApplication, installment PaymentDetail) []PaymentAllocation {
+
+	var allocations []PaymentAllocation
+	var allocatedPrincipal float64 = 0
+	var allocatedInterest float64 = 0
+	var leadIndex int = -1
+
+	// The installment belongs to the lenders who held the loan on its due date
+	participants := t.GetHoldingsAsOf(applicationDetails, installment.DueDate)
+	for i := 0; i < len(participants); i++ {
+		var allocation PaymentAllocation
+		allocation.LenderId = participants[i].LenderId
+		allocation.SharePercent = participants[i].SharePercent
+		allocation.PrincipalAmount = math.Floor(installment.PrincipalAmount*participants[i].SharePercent) / 100
+		allocation.InterestAmount = math.Floor(installment.InterestAmount*participants[i].SharePercent) / 100
+		allocatedPrincipal = allocatedPrincipal + allocation.PrincipalAmount
+		allocatedInterest = allocatedInterest + allocation.InterestAmount
+		if participants[i].IsLead {
+			leadIndex = len(allocations)
+		}
+		allocations = append(allocations, allocation)
+	}
+
+	// The rounding difference goes to the lead lender so that the allocations add up to the installment
+	if leadIndex >= 0 {
+		allocations[leadIndex].PrincipalAmount = allocations[leadIndex].PrincipalAmount + installment.PrincipalAmount - allocatedPrincipal
+		allocations[leadIndex].InterestAmount = allocations[leadIndex].InterestAmount + installment.InterestAmount - allocatedInterest
+	}
+	for i := 0; i < len(allocations); i++ {
+		allocations[i].TotalAmount = allocations[i].PrincipalAmount + allocations[i].InterestAmount
+	}
+
+	return allocations
+}
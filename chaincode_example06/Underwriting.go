@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Manual underwriting - Proposal statuses and decisions
+//==============================================================================================================================
+const UNDERWRITING_PROPOSED = "PROPOSED"
+const UNDERWRITING_APPROVED = "APPROVED"
+const UNDERWRITING_RETURNED = "RETURNED"
+
+const UNDERWRITING_ACCEPT = "ACCEPT"
+const UNDERWRITING_REJECT = "REJECT"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type UnderwritingProposal struct {
+	BiddingNumber    int
+	LenderId         int
+	Decision         string
+	SanctionedAmount float64
+	InterestRate     float64
+	Tenure           int
+	Comment          string
+	Status           string
+	ProposedBy       string
+	ProposedDate     time.Time
+	CheckedBy        string
+	CheckedDate      time.Time
+	CheckerComment   string
+}
+
+type UnderwritingQueueItem struct {
+	ApplicationNumber string
+	BiddingNumber     int
+	LoanAmount        float64
+	Tenure            int
+	ReferralReason    string
+	ReferredDate      time.Time
+	Status            string
+	Proposal          UnderwritingProposal
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the lender id, whether the lender underwrites manually, the loan amount from which and the
+// credit score below which applications are referred. With both criteria at zero every application is referred
+func (t *SmartLendingChaincode) SetUnderwritingPolicy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id, manual underwriting flag, referral amount and referral credit score")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = t.CheckLenderAccess(caller, lenderId)
+	if err != nil {
+		return nil, err
+	}
+	manualUnderwriting, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid manual underwriting flag")
+	}
+	referralAmount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || referralAmount < 0 {
+		return nil, errors.New("Invalid referral amount")
+	}
+	referralCreditScore, err := strconv.Atoi(args[3])
+	if err != nil || referralCreditScore < 0 {
+		return nil, errors.New("Invalid referral credit score")
+	}
+
+	product := t.GetLenderProduct(stub, lenderId)
+	product.ManualUnderwriting = manualUnderwriting
+	product.ReferralAmount = referralAmount
+	product.ReferralCreditScore = referralCreditScore
+
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(LENDER_PRODUCT_PREFIX+strconv.Itoa(lenderId), bytes)
+
+	return bytes, err
+}
+
+// Arguments are the application number, the referred bidding number, ACCEPT or REJECT, a comment and for
+// an acceptance the sanctioned amount, interest rate and tenure
+func (t *SmartLendingChaincode) ProposeUnderwritingTerms(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 && len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, bidding number, decision, comment and for an acceptance the sanctioned amount, interest rate and tenure")
+	}
+
+	applicationDetails, bidIndex, err := t.GetReferredBid(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	referredBid := applicationDetails.Quotations[bidIndex]
+	if t.GetOpenProposalIndex(applicationDetails, referredBid.BiddingNumber) >= 0 {
+		return nil, errors.New("Terms have already been proposed for the bid")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal := UnderwritingProposal{BiddingNumber: referredBid.BiddingNumber, LenderId: referredBid.LenderId, Decision: args[2], Comment: args[3], Status: UNDERWRITING_PROPOSED, ProposedBy: caller.Username, ProposedDate: t.GetTransactionTime(stub)}
+	if args[2] == UNDERWRITING_ACCEPT {
+		if len(args) != 7 {
+			return nil, errors.New("Sanctioned amount, interest rate and tenure are required to accept")
+		}
+		proposal.SanctionedAmount, err = strconv.ParseFloat(args[4], 64)
+		if err != nil || proposal.SanctionedAmount <= 0 || proposal.SanctionedAmount > applicationDetails.LoanAmount {
+			return nil, errors.New("Invalid sanctioned amount")
+		}
+		proposal.InterestRate, err = strconv.ParseFloat(args[5], 64)
+		if err != nil || proposal.InterestRate < 0 {
+			return nil, errors.New("Invalid interest rate")
+		}
+		proposal.Tenure, err = strconv.Atoi(args[6])
+		if err != nil || proposal.Tenure <= 0 {
+			return nil, errors.New("Invalid tenure")
+		}
+	} else if args[2] != UNDERWRITING_REJECT {
+		return nil, errors.New("Invalid decision")
+	} else if len(args) != 4 {
+		return nil, errors.New("Terms cannot be proposed with a rejection")
+	}
+
+	applicationDetails.Underwriting = append(applicationDetails.Underwriting, proposal)
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(proposal)
+}
+
+// Arguments are the application number, the referred bidding number, APPROVED or RETURNED and a comment
+func (t *SmartLendingChaincode) CheckUnderwritingTerms(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting application number, bidding number, decision and comment")
+	}
+	if args[2] != UNDERWRITING_APPROVED && args[2] != UNDERWRITING_RETURNED {
+		return nil, errors.New("Invalid decision")
+	}
+
+	applicationDetails, bidIndex, err := t.GetReferredBid(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	proposalIndex := t.GetOpenProposalIndex(applicationDetails, applicationDetails.Quotations[bidIndex].BiddingNumber)
+	if proposalIndex < 0 {
+		return nil, errors.New("No terms have been proposed for the bid")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checker must be someone other than the maker
+	proposal := applicationDetails.Underwriting[proposalIndex]
+	if proposal.ProposedBy == caller.Username {
+		return nil, errors.New("Terms must be checked by someone other than the proposer")
+	}
+	proposal.Status = args[2]
+	proposal.CheckedBy = caller.Username
+	proposal.CheckedDate = t.GetTransactionTime(stub)
+	proposal.CheckerComment = args[3]
+	applicationDetails.Underwriting[proposalIndex] = proposal
+
+	// Approved terms are published as the lender's bid, still subject to the lender's policies
+	if proposal.Status == UNDERWRITING_APPROVED {
+		evaluationParams, err := t.BuildEvaluationParams(stub, applicationDetails)
+		if err != nil {
+			return nil, err
+		}
+		applicationDetails.Quotations[bidIndex] = t.PublishUnderwrittenBid(stub, applicationDetails, applicationDetails.Quotations[bidIndex], proposal, evaluationParams)
+	}
+	applicationDetails = t.SaveApplicationDetails(stub, applicationDetails)
+
+	return json.Marshal(applicationDetails.Quotations[bidIndex])
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetUnderwritingQueue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting lender id")
+	}
+
+	lenderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Invalid lender id")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role != ADMIN {
+		err = t.CheckLenderAccess(caller, lenderId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applicationIndex, err := t.GetApplicationIndex(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Referred bids waiting for terms to be proposed or checked
+	var queue []UnderwritingQueueItem
+	for i := 0; i < len(applicationIndex); i++ {
+		applicationDetails, err := t.GetApplication(stub, applicationIndex[i])
+		if err != nil || applicationDetails.Status != STATE_QUOTATIONS_RECEIVED {
+			continue
+		}
+		for j := 0; j < len(applicationDetails.Quotations); j++ {
+			bidDetails := applicationDetails.Quotations[j]
+			if bidDetails.LenderId != lenderId || bidDetails.ApplicationAcceptStatus != LENDER_REFER_APPLICATION || bidDetails.IsSuperseded {
+				continue
+			}
+			item := UnderwritingQueueItem{ApplicationNumber: applicationDetails.ApplicationNumber, BiddingNumber: bidDetails.BiddingNumber, LoanAmount: applicationDetails.LoanAmount, Tenure: applicationDetails.Tenure, ReferralReason: bidDetails.ReferralReason, ReferredDate: bidDetails.BiddingDate, Status: "REFERRED"}
+			proposalIndex := t.GetOpenProposalIndex(applicationDetails, bidDetails.BiddingNumber)
+			if proposalIndex >= 0 {
+				item.Status = UNDERWRITING_PROPOSED
+				item.Proposal = applicationDetails.Underwriting[proposalIndex]
+			}
+			queue = append(queue, item)
+		}
+	}
+
+	return json.Marshal(queue)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) ApplyUnderwritingReferral(stub shim.ChaincodeStubInterface, bidDetails BiddingDetails, evaluationParams EvaluationParams) BiddingDetails {
+
+	if bidDetails.ApplicationAcceptStatus != LENDER_ACCEPT_APPLICATION {
+		return bidDetails
+	}
+	product := t.GetLenderProduct(stub, bidDetails.LenderId)
+	if !product.ManualUnderwriting {
+		return bidDetails
+	}
+
+	var reasons []string
+	if product.ReferralAmount > 0 && evaluationParams.LoanAmount >= product.ReferralAmount {
+		reasons = append(reasons, "Loan amount of "+strconv.FormatFloat(product.ReferralAmount, 'f', -1, 64)+" or more")
+	}
+	if product.ReferralCreditScore > 0 && evaluationParams.CreditScore < product.ReferralCreditScore {
+		reasons = append(reasons, "Credit score below "+strconv.Itoa(product.ReferralCreditScore))
+	}
+	if product.ReferralAmount <= 0 && product.ReferralCreditScore <= 0 {
+		reasons = append(reasons, "All applications are underwritten manually")
+	}
+	if len(reasons) == 0 {
+		return bidDetails
+	}
+
+	// The automatic terms are withheld until an underwriter's terms have been checked
+	return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, BiddingNumber: bidDetails.BiddingNumber, BiddingDate: bidDetails.BiddingDate, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REFER_APPLICATION, ReferralReason: strings.Join(reasons, "; ")}
+}
+
+func (t *SmartLendingChaincode) GetReferredBid(stub shim.ChaincodeStubInterface, applicationNumber string, biddingNumberArg string) (LoanApplication, int, error) {
+
+	applicationDetails, err := t.GetApplication(stub, applicationNumber)
+	if err != nil {
+		return applicationDetails, -1, err
+	}
+	biddingNumber, err := strconv.Atoi(biddingNumberArg)
+	if err != nil {
+		return applicationDetails, -1, errors.New("Invalid bidding number")
+	}
+	if applicationDetails.Status != STATE_QUOTATIONS_RECEIVED {
+		return applicationDetails, -1, errors.New("Application is not open for quotations")
+	}
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return applicationDetails, -1, err
+	}
+
+	for i := 0; i < len(applicationDetails.Quotations); i++ {
+		bidDetails := applicationDetails.Quotations[i]
+		if bidDetails.BiddingNumber != biddingNumber || bidDetails.ApplicationAcceptStatus != LENDER_REFER_APPLICATION || bidDetails.IsSuperseded {
+			continue
+		}
+		err = t.CheckLenderAccess(caller, bidDetails.LenderId)
+		if err != nil {
+			return applicationDetails, -1, err
+		}
+		return applicationDetails, i, nil
+	}
+	return applicationDetails, -1, errors.New("No referred bid found")
+}
+
+func (t *SmartLendingChaincode) GetOpenProposalIndex(applicationDetails LoanApplication, biddingNumber int) int {
+	for i := 0; i < len(applicationDetails.Underwriting); i++ {
+		if applicationDetails.Underwriting[i].BiddingNumber == biddingNumber && applicationDetails.Underwriting[i].Status == UNDERWRITING_PROPOSED {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *SmartLendingChaincode) PublishUnderwrittenBid(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, referredBid BiddingDetails, proposal UnderwritingProposal, evaluationParams EvaluationParams) BiddingDetails {
+
+	bidDetails := BiddingDetails{ApplicationNumber: referredBid.ApplicationNumber, BiddingNumber: referredBid.BiddingNumber, BiddingDate: t.GetTransactionTime(stub), LenderId: referredBid.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: proposal.Comment}
+	if proposal.Decision == UNDERWRITING_ACCEPT {
+		bidDetails.ApplicationAcceptStatus = LENDER_ACCEPT_APPLICATION
+		bidDetails.RejectionReason = ""
+		bidDetails.SanctionedAmount = proposal.SanctionedAmount
+		bidDetails.InterestType = "simple"
+		bidDetails.InterestRate = proposal.InterestRate
+		bidDetails.Tenure = proposal.Tenure
+		bidDetails = t.ApplyLTVPolicy(stub, bidDetails, evaluationParams)
+		bidDetails = t.ApplyAffordabilityPolicy(stub, bidDetails, evaluationParams)
+		bidDetails = t.ApplyExposureLimits(stub, bidDetails, applicationDetails)
+		if bidDetails.ApplicationAcceptStatus == LENDER_ACCEPT_APPLICATION {
+			bidDetails.BidValidUntil = t.GetBidValidUntil(stub, bidDetails.LenderId)
+		}
+	}
+
+	// The policies may replace the bid so the underwriting details are stamped last
+	bidDetails.BiddingNumber = referredBid.BiddingNumber
+	bidDetails.ReferralReason = referredBid.ReferralReason
+	bidDetails.UnderwrittenBy = proposal.ProposedBy
+	bidDetails.ApprovedBy = proposal.CheckedBy
+	return bidDetails
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Vehicle registry - Keys
+//==============================================================================================================================
+const VEHICLE_PREFIX = "VEHICLE_"
+
+//==============================================================================================================================
+//	Status types - Lien on a vehicle
+//==============================================================================================================================
+const LIEN_ACTIVE = "ACTIVE"
+const LIEN_RELEASED = "RELEASED"
+const LIEN_TRANSFERRED = "TRANSFERRED"
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type VehicleAsset struct {
+	VIN            string
+	Make           string
+	Model          string
+	Year           int
+	DealerId       string
+	Price          float64
+	RegisteredDate time.Time
+	Liens          []Lien
+}
+
+type Lien struct {
+	LenderId             int
+	ApplicationNumber    string
+	Amount               float64
+	Status               string
+	RegisteredDate       time.Time
+	RegistrationTxId     string
+	ReleasedDate         time.Time
+	ReleaseTransactionId string
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the VIN, make, model, year, price and the dealer id when registered by an admin
+func (t *SmartLendingChaincode) RegisterVehicle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting VIN, make, model, year and price")
+	}
+
+	vin := strings.ToUpper(args[0])
+	if !t.IsValidVIN(vin) {
+		return nil, errors.New("Invalid VIN")
+	}
+	bytes, err := stub.GetState(VEHICLE_PREFIX + vin)
+	if err != nil {
+		return nil, err
+	}
+	if bytes != nil {
+		return nil, errors.New("Vehicle already registered")
+	}
+	year, err := strconv.Atoi(args[3])
+	if err != nil || year <= 0 {
+		return nil, errors.New("Invalid year")
+	}
+	price, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || price <= 0 {
+		return nil, errors.New("Invalid price")
+	}
+
+	// Dealers register the vehicles they sell
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+	dealerId := caller.Username
+	if caller.Role == ADMIN {
+		if len(args) < 6 || args[5] == "" {
+			return nil, errors.New("Dealer id is required")
+		}
+		dealerId = args[5]
+	}
+
+	vehicle := VehicleAsset{VIN: vin, Make: args[1], Model: args[2], Year: year, DealerId: dealerId, Price: price, RegisteredDate: t.GetTransactionTime(stub)}
+	// List the vehicle in the dealer's inventory
+	err = t.AddToDealerInventory(stub, dealerId, vin)
+	if err != nil {
+		return nil, err
+	}
+	err = t.SaveVehicle(stub, vehicle)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(vehicle)
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetVehicle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting VIN")
+	}
+
+	vehicle, err := t.GetVehicleDetails(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(vehicle)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetVehicleDetails(stub shim.ChaincodeStubInterface, vin string) (VehicleAsset, error) {
+
+	var vehicle VehicleAsset
+	bytes, err := stub.GetState(VEHICLE_PREFIX + strings.ToUpper(vin))
+	if err != nil {
+		return vehicle, err
+	}
+	if bytes == nil {
+		return vehicle, errors.New("Could not find vehicle")
+	}
+	err = json.Unmarshal(bytes, &vehicle)
+	return vehicle, err
+}
+
+func (t *SmartLendingChaincode) SaveVehicle(stub shim.ChaincodeStubInterface, vehicle VehicleAsset) error {
+
+	bytes, err := json.Marshal(vehicle)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(VEHICLE_PREFIX+vehicle.VIN, bytes)
+}
+
+func (t *SmartLendingChaincode) IsValidVIN(vin string) bool {
+
+	// A VIN has 17 characters and never uses I, O or Q
+	if len(vin) != 17 {
+		return false
+	}
+	for i := 0; i < len(vin); i++ {
+		c := vin[i]
+		if c == 'I' || c == 'O' || c == 'Q' {
+			return false
+		}
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *SmartLendingChaincode) HasActiveLien(vehicle VehicleAsset) bool {
+	for i := 0; i < len(vehicle.Liens); i++ {
+		if vehicle.Liens[i].Status == LIEN_ACTIVE {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SmartLendingChaincode) RegisterLien(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, winningBid BiddingDetails) error {
+
+	// Applications without a registered vehicle carry no collateral
+	if applicationDetails.VIN == "" {
+		return nil
+	}
+
+	vehicle, err := t.GetVehicleDetails(stub, applicationDetails.VIN)
+	if err != nil {
+		return err
+	}
+	if t.HasActiveLien(vehicle) {
+		return errors.New("Vehicle is already encumbered")
+	}
+
+	var lien Lien
+	lien.LenderId = winningBid.LenderId
+	lien.ApplicationNumber = applicationDetails.ApplicationNumber
+	lien.Amount = winningBid.SanctionedAmount
+	lien.Status = LIEN_ACTIVE
+	lien.RegisteredDate = t.GetTransactionTime(stub)
+	lien.RegistrationTxId = stub.GetTxID()
+	vehicle.Liens = append(vehicle.Liens, lien)
+
+	return t.SaveVehicle(stub, vehicle)
+}
+
+func (t *SmartLendingChaincode) ReleaseLien(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) error {
+
+	if applicationDetails.VIN == "" {
+		return nil
+	}
+
+	vehicle, err := t.GetVehicleDetails(stub, applicationDetails.VIN)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(vehicle.Liens); i++ {
+		if vehicle.Liens[i].ApplicationNumber == applicationDetails.ApplicationNumber && vehicle.Liens[i].Status == LIEN_ACTIVE {
+			vehicle.Liens[i].Status = LIEN_RELEASED
+			vehicle.Liens[i].ReleasedDate = t.GetTransactionTime(stub)
+			vehicle.Liens[i].ReleaseTransactionId = stub.GetTxID()
+		}
+	}
+
+	return t.SaveVehicle(stub, vehicle)
+}
+
+func (t *SmartLendingChaincode) TransferLien(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, lenderId int) error {
+
+	if applicationDetails.VIN == "" {
+		return nil
+	}
+
+	vehicle, err := t.GetVehicleDetails(stub, applicationDetails.VIN)
+	if err != nil {
+		return err
+	}
+
+	// Assign the active lien of the loan to the new lender
+	for i := 0; i < len(vehicle.Liens); i++ {
+		if vehicle.Liens[i].ApplicationNumber != applicationDetails.ApplicationNumber || vehicle.Liens[i].Status != LIEN_ACTIVE {
+			continue
+		}
+		lien := vehicle.Liens[i]
+		lien.LenderId = lenderId
+		lien.RegisteredDate = t.GetTransactionTime(stub)
+		lien.RegistrationTxId = stub.GetTxID()
+
+		vehicle.Liens[i].Status = LIEN_TRANSFERRED
+		vehicle.Liens[i].ReleasedDate = t.GetTransactionTime(stub)
+		vehicle.Liens[i].ReleaseTransactionId = stub.GetTxID()
+		vehicle.Liens = append(vehicle.Liens, lien)
+		break
+	}
+
+	return t.SaveVehicle(stub, vehicle)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Vehicle valuation - Keys
+//==============================================================================================================================
+const VALUATION_PREFIX = "VALUATION_"
+const DEPRECIATION_CURVE = "_depreciationcurve"
+
+//==============================================================================================================================
+//	 Vehicle valuation - Defaults
+//==============================================================================================================================
+// Percentage of the base price retained by a vehicle for each year of age, the last entry applies to older vehicles
+var defaultDepreciationCurve = []float64{100, 85, 72, 61, 52, 44, 37, 31, 26, 22}
+
+//==============================================================================================================================
+//	Models
+//==============================================================================================================================
+
+type VehicleValuation struct {
+	Make        string
+	Model       string
+	Year        int
+	BasePrice   float64
+	UpdatedBy   string
+	UpdatedDate time.Time
+}
+
+type AssetValuation struct {
+	VIN             string
+	Make            string
+	Model           string
+	Year            int
+	BasePrice       float64
+	AgeInYears      int
+	RetainedPercent float64
+	AssetValue      float64
+	ValuationDate   time.Time
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+
+// Arguments are the make, model, year and base price
+func (t *SmartLendingChaincode) SetVehicleValuation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting make, model, year and base price")
+	}
+	if args[0] == "" || args[1] == "" {
+		return nil, errors.New("Make and model are required")
+	}
+	year, err := strconv.Atoi(args[2])
+	if err != nil || year <= 0 {
+		return nil, errors.New("Invalid year")
+	}
+	basePrice, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || basePrice <= 0 {
+		return nil, errors.New("Invalid base price")
+	}
+
+	caller, err := t.GetCallerDetails(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valuation := VehicleValuation{Make: args[0], Model: args[1], Year: year, BasePrice: basePrice, UpdatedBy: caller.Username, UpdatedDate: t.GetTransactionTime(stub)}
+	bytes, err := json.Marshal(valuation)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(t.GetValuationKey(args[0], args[1], year), bytes)
+
+	return bytes, err
+}
+
+// Arguments are the retained percentages of the base price for each year of age
+func (t *SmartLendingChaincode) SetDepreciationCurve(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) == 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting the retained percentage for each year of age")
+	}
+
+	var curve []float64
+	for i := 0; i < len(args); i++ {
+		retained, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || retained < 0 || retained > 100 {
+			return nil, errors.New("Invalid retained percentage")
+		}
+		// Vehicles do not appreciate with age
+		if i > 0 && retained > curve[i-1] {
+			return nil, errors.New("Depreciation curve must not increase with age")
+		}
+		curve = append(curve, retained)
+	}
+
+	bytes, err := json.Marshal(curve)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(DEPRECIATION_CURVE, bytes)
+
+	return bytes, err
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetVehicleValuation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting VIN")
+	}
+
+	valuation, err := t.GetAssetValuation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(valuation)
+}
+
+//==============================================================================================================================
+//	 Private functions
+//==============================================================================================================================
+
+func (t *SmartLendingChaincode) GetValuationKey(make string, model string, year int) string {
+	return VALUATION_PREFIX + strings.ToUpper(make) + "_" + strings.ToUpper(model) + "_" + strconv.Itoa(year)
+}
+
+func (t *SmartLendingChaincode) GetDepreciationCurve(stub shim.ChaincodeStubInterface) []float64 {
+
+	// Fall back to the default curve when none has been configured
+	bytes, err := stub.GetState(DEPRECIATION_CURVE)
+	if err != nil || bytes == nil {
+		return defaultDepreciationCurve
+	}
+	var curve []float64
+	err = json.Unmarshal(bytes, &curve)
+	if err != nil || len(curve) == 0 {
+		return defaultDepreciationCurve
+	}
+	return curve
+}
+
+func (t *SmartLendingChaincode) GetAssetValuation(stub shim.ChaincodeStubInterface, vin string) (AssetValuation, error) {
+
+	var assetValuation AssetValuation
+
+	vehicle, err := t.GetVehicleDetails(stub, vin)
+	if err != nil {
+		return assetValuation, err
+	}
+	bytes, err := stub.GetState(t.GetValuationKey(vehicle.Make, vehicle.Model, vehicle.Year))
+	if err != nil {
+		return assetValuation, err
+	}
+	if bytes == nil {
+		return assetValuation, errors.New("No valuation found for the vehicle")
+	}
+	var valuation VehicleValuation
+	err = json.Unmarshal(bytes, &valuation)
+	if err != nil {
+		return assetValuation, err
+	}
+
+	// Depreciate the base price by the age of the vehicle
+	currentTime := t.GetTransactionTime(stub)
+	age := currentTime.Year() - vehicle.Year
+	if age < 0 {
+		age = 0
+	}
+	curve := t.GetDepreciationCurve(stub)
+	retainedPercent := curve[len(curve)-1]
+	if age < len(curve) {
+		retainedPercent = curve[age]
+	}
+
+	assetValuation.VIN = vehicle.VIN
+	assetValuation.Make = vehicle.Make
+	assetValuation.Model = vehicle.Model
+	assetValuation.Year = vehicle.Year
+	assetValuation.BasePrice = valuation.BasePrice
+	assetValuation.AgeInYears = age
+	assetValuation.RetainedPercent = retainedPercent
+	assetValuation.AssetValue = math.Floor(valuation.BasePrice*retainedPercent) / 100
+	assetValuation.ValuationDate = currentTime
+
+	return assetValuation, nil
+}
+
+func (t *SmartLendingChaincode) GetAssetValue(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication) float64 {
+
+	// Vehicles without a registry entry or a valuation cannot be valued
+	if applicationDetails.VIN == "" {
+		return 0
+	}
+	valuation, err := t.GetAssetValuation(stub, applicationDetails.VIN)
+	if err != nil {
+		return 0
+	}
+	return valuation.AssetValue
+}
+
+func (t *SmartLendingChaincode) GetMaxSanctionAmount(product LenderProduct, assetValue float64) float64 {
+	return math.Floor(assetValue*product.MaxLTV) / 100
+}
+
+func (t *SmartLendingChaincode) ApplyLTVPolicy(stub shim.ChaincodeStubInterface, bidDetails BiddingDetails, evaluationParams EvaluationParams) BiddingDetails {
+
+	if bidDetails.ApplicationAcceptStatus != LENDER_ACCEPT_APPLICATION {
+		return bidDetails
+	}
+
+	// A maximum LTV of zero means the lender does not lend against the asset value
+	product := t.GetLenderProduct(stub, bidDetails.LenderId)
+	if product.MaxLTV <= 0 {
+		return bidDetails
+	}
+	if evaluationParams.AssetValue <= 0 {
+		return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: "Vehicle could not be valued"}
+	}
+
+	// Reduce the sanction to the maximum LTV when the lender allows it
+	maxAmount := t.GetMaxSanctionAmount(product, evaluationParams.AssetValue)
+	if bidDetails.SanctionedAmount > maxAmount {
+		if !product.AllowReducedSanction {
+			return BiddingDetails{ApplicationNumber: bidDetails.ApplicationNumber, LenderId: bidDetails.LenderId, ApplicationAcceptStatus: LENDER_REJECT_APPLICATION, RejectionReason: "Loan amount exceeds the maximum LTV"}
+		}
+		bidDetails.SanctionedAmount = maxAmount
+	}
+	bidDetails.LoanToValue = math.Round(bidDetails.SanctionedAmount*10000/evaluationParams.AssetValue) / 100
+
+	return bidDetails
+}
+
+func (t *SmartLendingChaincode) CheckLTV(stub shim.ChaincodeStubInterface, applicationDetails LoanApplication, lenderId int, sanctionedAmount float64) error {
+
+	product := t.GetLenderProduct(stub, lenderId)
+	if product.MaxLTV <= 0 {
+		return nil
+	}
+	assetValue := t.GetAssetValue(stub, applicationDetails)
+	if assetValue <= 0 {
+		return errors.New("Vehicle could not be valued")
+	}
+	if sanctionedAmount > t.GetMaxSanctionAmount(product, assetValue) {
+		return errors.New("Sanctioned amount exceeds the maximum LTV")
+	}
+	return nil
+}